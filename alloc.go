@@ -0,0 +1,191 @@
+package goblin
+
+import (
+	"fmt"
+	"sort"
+)
+
+// a run of contiguous pages in data.db, as reported by ErrCorrupt and Verify
+type Extent struct {
+	Start int `json:"start"`
+	Len   int `json:"len"`
+}
+
+func (this Extent) end() int {
+	return this.Start + this.Len
+}
+
+func (this Extent) String() string {
+	if this.Len == 1 {
+		return fmt.Sprint(this.Start)
+	}
+	return fmt.Sprintf("%d-%d", this.Start, this.end()-1)
+}
+
+// the pages of a value, in order
+type extents []Extent
+
+// how many pages
+func (this extents) count() int {
+	ct := 0
+	for _, e := range this {
+		ct += e.Len
+	}
+	return ct
+}
+
+// the last page + 1, or 0 if empty
+func (this extents) end() int {
+	end := 0
+	for _, e := range this {
+		if e.end() > end {
+			end = e.end()
+		}
+	}
+	return end
+}
+
+// each page, in order
+func (this extents) pages() []int {
+	var out []int
+	for _, e := range this {
+		for page := e.Start; page < e.end(); page++ {
+			out = append(out, page)
+		}
+	}
+	return out
+}
+
+// add more pages after these, merging the runs which touch
+func (this extents) append(more extents) extents {
+	for _, e := range more {
+		if l := len(this); l > 0 && this[l-1].end() == e.Start {
+			this[l-1].Len += e.Len
+		} else {
+			this = append(this, e)
+		}
+	}
+	return this
+}
+
+// group the pages in runs
+func toExtents(pages []int) extents {
+	var out extents
+	for _, page := range pages {
+		if l := len(out); l > 0 && out[l-1].end() == page {
+			out[l-1].Len++
+		} else {
+			out = append(out, Extent{page, 1})
+		}
+	}
+	return out
+}
+
+// the free pages, as sorted extents which never touch each other
+type freeList struct {
+	list  []Extent
+	total int // pages
+}
+
+func (this *freeList) len() int {
+	return this.total
+}
+
+// add the pages, merging them with their neighbours
+func (this *freeList) put(pages extents) {
+	for _, e := range pages {
+		if e.Len == 0 {
+			continue
+		}
+		this.total += e.Len
+		i := sort.Search(len(this.list), func(i int) bool {
+			return this.list[i].Start > e.Start
+		})
+		if i > 0 && this.list[i-1].end() == e.Start {
+			this.list[i-1].Len += e.Len
+			if i < len(this.list) && this.list[i-1].end() == this.list[i].Start {
+				this.list[i-1].Len += this.list[i].Len
+				this.list = append(this.list[:i], this.list[i+1:]...)
+			}
+			continue
+		}
+		if i < len(this.list) && e.end() == this.list[i].Start {
+			this.list[i].Start = e.Start
+			this.list[i].Len += e.Len
+			continue
+		}
+		this.list = append(this.list, Extent{})
+		copy(this.list[i+1:], this.list[i:])
+		this.list[i] = e
+	}
+}
+
+// take n contiguous pages before limit, from the first run long enough
+func (this *freeList) takeRun(n, limit int) extents {
+	for i, e := range this.list {
+		if e.Start+n > limit {
+			return nil
+		}
+		if e.Len >= n {
+			this.remove(i, n)
+			return extents{{e.Start, n}}
+		}
+	}
+	return nil
+}
+
+// take n pages before limit, contiguous if possible, otherwise from the first runs
+func (this *freeList) take(n, limit int) extents {
+	if out := this.takeRun(n, limit); out != nil {
+		return out
+	}
+	avail := 0
+	for _, e := range this.list {
+		if e.Start >= limit {
+			break
+		}
+		if e.end() > limit {
+			avail += limit - e.Start
+		} else {
+			avail += e.Len
+		}
+	}
+	if avail < n {
+		return nil
+	}
+	var out extents
+	for n > 0 {
+		e := this.list[0]
+		l := e.Len
+		if l > n {
+			l = n
+		}
+		this.remove(0, l)
+		out = append(out, Extent{e.Start, l})
+		n -= l
+	}
+	return out
+}
+
+// remove the first n pages of the i-th run
+func (this *freeList) remove(i, n int) {
+	this.total -= n
+	if this.list[i].Len == n {
+		this.list = append(this.list[:i], this.list[i+1:]...)
+		return
+	}
+	this.list[i].Start += n
+	this.list[i].Len -= n
+}
+
+// if the last run ends at end, remove it and return where it starts, otherwise return end
+func (this *freeList) trim(end int) int {
+	l := len(this.list)
+	if l == 0 || this.list[l-1].end() != end {
+		return end
+	}
+	start := this.list[l-1].Start
+	this.total -= this.list[l-1].Len
+	this.list = this.list[:l-1]
+	return start
+}
@@ -0,0 +1,69 @@
+package goblin_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ohait/goblin"
+)
+
+func TestExtents(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.Open("/tmp/test-goblin/", goblin.Options{MaxSize: 64 << 10})
+	noError(t, err)
+
+	// a large value is a single extent, so its record is small
+	noError(t, db.Store("big", long(20000)))
+	fs, err := os.Stat("/tmp/test-goblin/index.log")
+	noError(t, err)
+	if fs.Size() > 40 {
+		t.Fatalf("expected a short record, index.log is %d bytes", fs.Size())
+	}
+
+	// fill the file with one page values, then free every other one
+	for i := 0; ; i++ {
+		err := db.Store(fmt.Sprintf("small-%03d", i), long(200))
+		if err == goblin.ErrFull {
+			break
+		}
+		noError(t, err)
+	}
+	for i := 0; i < 100; i += 2 {
+		noError(t, db.Delete(fmt.Sprintf("small-%03d", i)))
+	}
+
+	// the file can't grow, so this must be scattered in the holes
+	noError(t, db.Store("scattered", long(3000)))
+	x, err := db.Fetch("scattered")
+	noError(t, err)
+	if string(x) != string(long(3000)) {
+		t.Fatalf("expected long(3000), got %d bytes", len(x))
+	}
+	x, err = db.Fetch("small-001")
+	noError(t, err)
+	if string(x) != string(long(200)) {
+		t.Fatalf("expected long(200), got %d bytes", len(x))
+	}
+	noError(t, db.Close())
+
+	db, err = goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	x, err = db.Fetch("scattered")
+	noError(t, err)
+	if string(x) != string(long(3000)) {
+		t.Fatalf("expected long(3000), got %d bytes", len(x))
+	}
+	x, err = db.Fetch("big")
+	noError(t, err)
+	if string(x) != string(long(20000)) {
+		t.Fatalf("expected long(20000), got %d bytes", len(x))
+	}
+	noError(t, db.Close())
+
+	report, err := goblin.Verify("/tmp/test-goblin/")
+	noError(t, err)
+	if !report.OK() {
+		t.Fatalf("verify: %v", report)
+	}
+}
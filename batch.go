@@ -0,0 +1,74 @@
+package goblin
+
+// A list of changes to be applied atomically by DB.Write
+type Batch struct {
+	ops  []record
+	data [][]byte
+}
+
+// add an upsert to the batch, data is not copied until Write is called
+func (this *Batch) Put(key string, data []byte) {
+	this.ops = append(this.ops, record{Key: key})
+	this.data = append(this.data, data)
+}
+
+// add a deletion to the batch
+func (this *Batch) Delete(key string) {
+	this.ops = append(this.ops, record{Key: key, Deleted: true})
+	this.data = append(this.data, nil)
+}
+
+// how many changes are in the batch
+func (this *Batch) Len() int {
+	return len(this.ops)
+}
+
+// empty the batch so it can be reused
+func (this *Batch) Reset() {
+	this.ops = this.ops[:0]
+	this.data = this.data[:0]
+}
+
+// apply all the changes in the batch, in order
+// the batch is written in the log as a single entry, so on restart either all of it is replayed or none
+func (this *DB) Write(b *Batch) error {
+	this.m.Lock()
+	defer this.m.Unlock()
+	return this.writeBatch(b)
+}
+
+// must be called while holding the lock
+func (this *DB) writeBatch(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+
+	group := record{Batch: make([]record, 0, b.Len())}
+	release := func() {
+		for _, r := range group.Batch {
+			this.dispose(r.val())
+		}
+	}
+	for i, op := range b.ops {
+		if op.Deleted {
+			group.Batch = append(group.Batch, op)
+			continue
+		}
+		r, err := this.alloc(op.Key, b.data[i])
+		if err != nil {
+			release()
+			return err
+		}
+		group.Batch = append(group.Batch, r)
+	}
+
+	group.Version = this.seq + 1
+	err := this.writeLog(group)
+	if err != nil {
+		release()
+		return err
+	}
+
+	this.commit(group)
+	return nil
+}
@@ -0,0 +1,121 @@
+package goblin
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// call fn with the value of key (nil if missing), without copying it when it's contiguous in data.db
+// b aliases the mmap: it must not be modified, nor used after fn returns
+// the checksum is verified before calling fn
+// fn can use the DB, and data.db can grow or shrink meanwhile: the mapping b is in stays until fn returns
+func (this *DB) Borrow(key string, fn func(b []byte) error) error {
+	e := this.pin()
+	defer this.unpin(e)
+	val := this.trie.Get(key)
+	if val == nil {
+		return fn(nil)
+	}
+	return this.borrow(key, *val, fn)
+}
+
+// like Fetch, but see DB.Borrow
+func (this Pair) Borrow(fn func(b []byte) error) error {
+	if this.sto == nil {
+		return fn(this.data)
+	}
+	e := this.sto.pin()
+	defer this.sto.unpin(e)
+	val := this.current()
+	if val == nil {
+		return fn(nil)
+	}
+	return this.sto.borrow(this.Key, *val, fn)
+}
+
+// must be called while pinned, so the pages are not reused
+func (this *DB) borrow(key string, val value, fn func(b []byte) error) error {
+	if val.Inline != nil {
+		return fn(val.Inline)
+	}
+	start := 0
+	switch {
+	case val.Class > 0:
+		start = val.Slot * val.Class
+	case len(val.Extents) == 1:
+		start = val.Extents[0].Start * this.pageSize
+	case len(val.Extents) > 1:
+		// scattered, it must be copied
+		data, err := this.load(key, val)
+		if err != nil {
+			return err
+		}
+		return fn(data)
+	}
+
+	this.mm.RLock()
+	var b []byte
+	if end := start + val.Size; end <= len(this.mmap) {
+		b = this.mmap[start:end:end]
+		m := this.mmap
+		this.hold(m)
+		defer this.unhold(m)
+	} // otherwise it's a stale value, the file was shrunk after it was read
+	this.mm.RUnlock()
+	err := val.verify(key, b, this.pageSize)
+	if err != nil {
+		return err
+	}
+	return fn(b)
+}
+
+// the users of a mapping of data.db, see DB.hold
+type mapping struct {
+	users int  // Borrow callbacks running on it
+	stale bool // replaced by remmap, to be unmapped by the last user
+}
+
+// keep the mapping m while it's borrowed, even if remmap replaces it
+// must be called while holding mm for reading
+func (this *DB) hold(m []byte) {
+	this.bm.Lock()
+	defer this.bm.Unlock()
+	if this.held == nil {
+		this.held = map[*byte]*mapping{}
+	}
+	u := this.held[&m[0]]
+	if u == nil {
+		u = &mapping{}
+		this.held[&m[0]] = u
+	}
+	u.users++
+}
+
+// unmap m if it was replaced and this was the last user
+func (this *DB) unhold(m []byte) {
+	this.bm.Lock()
+	defer this.bm.Unlock()
+	u := this.held[&m[0]]
+	u.users--
+	if u.users > 0 {
+		return
+	}
+	delete(this.held, &m[0])
+	if u.stale {
+		err := unix.Munmap(m)
+		if err != nil {
+			this.logger("munmap: %v", err)
+		}
+	}
+}
+
+// unmap m, or leave it to the last user if it's borrowed
+// must be called while holding mm
+func (this *DB) unmap(m []byte) error {
+	this.bm.Lock()
+	defer this.bm.Unlock()
+	if u := this.held[&m[0]]; u != nil {
+		u.stale = true
+		return nil
+	}
+	return unix.Munmap(m)
+}
@@ -0,0 +1,90 @@
+package goblin_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ohait/goblin"
+)
+
+func TestBorrow(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.Open("/tmp/test-goblin/", goblin.Options{InitialSize: 64 << 10})
+	noError(t, err)
+	defer db.Close()
+
+	for _, size := range []int{3, 100, 50000} { // inline, in a slot, in pages
+		noError(t, db.Store("k", long(size)))
+		err = db.Borrow("k", func(b []byte) error {
+			if string(b) != string(long(size)) {
+				t.Fatalf("expected long(%d), got %d bytes", size, len(b))
+			}
+			return nil
+		})
+		noError(t, err)
+	}
+
+	// no copy
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = db.Borrow("k", func(b []byte) error { return nil })
+	})
+	if allocs > 2 {
+		t.Fatalf("expected no copy, got %v allocations", allocs)
+	}
+
+	err = db.Borrow("missing", func(b []byte) error {
+		if b != nil {
+			t.Fatalf("expected nil, got %d bytes", len(b))
+		}
+		return nil
+	})
+	noError(t, err)
+
+	err = db.Range(func(p goblin.Pair) error {
+		return p.Borrow(func(b []byte) error {
+			if string(b) != string(long(50000)) {
+				t.Fatalf("expected long(50000), got %d bytes", len(b))
+			}
+			return nil
+		})
+	})
+	noError(t, err)
+
+	// the value stays there while borrowed, even if it's overwritten and data.db grows
+	// and fn can use the DB meanwhile
+	err = db.Borrow("k", func(b []byte) error {
+		stored := make(chan error)
+		go func() {
+			stored <- db.Store("k", long(200000))
+		}()
+		select {
+		case err := <-stored:
+			noError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the store is waiting for Borrow")
+		}
+		x, err := db.Fetch("k")
+		noError(t, err)
+		if string(x) != string(long(200000)) {
+			t.Fatalf("expected long(200000), got %d bytes", len(x))
+		}
+		err = db.Borrow("k", func(b []byte) error {
+			if string(b) != string(long(200000)) {
+				t.Fatalf("expected long(200000), got %d bytes", len(b))
+			}
+			return nil
+		})
+		noError(t, err)
+		if string(b) != string(long(50000)) {
+			t.Fatalf("expected long(50000), got %d bytes", len(b))
+		}
+		return nil
+	})
+	noError(t, err)
+	x, err := db.Fetch("k")
+	noError(t, err)
+	if string(x) != string(long(200000)) {
+		t.Fatalf("expected long(200000), got %d bytes", len(x))
+	}
+}
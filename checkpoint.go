@@ -0,0 +1,353 @@
+package goblin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// the checkpoint is a copy of the index as it was at some point of the log,
+// so on open only the log entries written after it must be replayed:
+//
+//	magic "gckp"
+//	format version, page size, seq (uvarints)
+//	log offset, number of log records up to it (uvarints)
+//	header of the last log entry before the offset (8 bytes)
+//	next page (uvarint)
+//	each key in lexicographic order, as its length (uvarint) and:
+//	  the length of the prefix shared with the previous key (uvarint)
+//	  version (uvarint)
+//	  the record for the rest of the key, encoded as in the log
+//	a 0 length
+//	the bitmap of the used pages: number of words (uvarint), then each word (uint64, little endian)
+//	CRC32C of all the above (uint32, little endian)
+const ckptMagic = "gckp"
+const ckptName = "index.ckpt"
+
+// where a checkpoint is in the log
+type checkpoint struct {
+	seq     uint64
+	off     int64 // the log entries from here are not in the checkpoint
+	records int   // log records before off
+	last    [frameHeader]byte
+	next    int
+}
+
+// the checkpoint doesn't match the log, which must be replayed from the start
+var errStale = errors.New("stale checkpoint")
+
+// save the index, so the next open only replays the log written after this
+func (this *DB) Checkpoint() error {
+	this.m.Lock()
+	s, c, gen, err := this.beginCheckpoint()
+	this.m.Unlock()
+	if err != nil {
+		return err
+	}
+	return this.checkpoint(s, c, gen)
+}
+
+// start a checkpoint in background if enough log was written since the last one
+// must be called while holding the lock
+func (this *DB) autoCheckpoint() {
+	if this.opts.CheckpointEvery <= 0 || this.ckptBusy || this.logOff-this.ckptOff < int64(this.opts.CheckpointEvery) {
+		return
+	}
+	s, c, gen, err := this.beginCheckpoint()
+	if err != nil {
+		this.logger("can't checkpoint: %v", err)
+		return
+	}
+	this.ckptBusy = true
+	this.ckptWG.Add(1)
+	go func() {
+		defer this.ckptWG.Done()
+		err := this.checkpoint(s, c, gen)
+		if err != nil {
+			this.logger("can't checkpoint: %v", err)
+		}
+		this.m.Lock()
+		this.ckptBusy = false
+		this.m.Unlock()
+	}()
+}
+
+// the log must be on disk before a checkpoint can point to it
+// must be called while holding the lock
+func (this *DB) beginCheckpoint() (*snapshot, checkpoint, int, error) {
+	err := this.log.Sync()
+	if err != nil {
+		return nil, checkpoint{}, 0, err
+	}
+	c := checkpoint{
+		seq:     this.seq,
+		off:     this.logOff,
+		records: this.logRecords,
+		last:    this.logLast,
+		next:    this.next,
+	}
+	return this.snapshot_(), c, this.logGen, nil
+}
+
+// write the checkpoint for the snapshot, unless the log was rewritten in the meantime
+func (this *DB) checkpoint(s *snapshot, c checkpoint, gen int) error {
+	defer this.release(s)
+	this.ckm.Lock()
+	defer this.ckm.Unlock()
+
+	fname := filepath.Join(this.dir, ckptName)
+	f, err := os.OpenFile(fname+"~", os.O_RDWR|os.O_CREATE|os.O_TRUNC, this.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := crc32.New(castagnoli)
+	w := bufio.NewWriterSize(io.MultiWriter(f, h), 1<<16)
+
+	out := []byte(ckptMagic)
+	out = binary.AppendUvarint(out, formatVersion)
+	out = binary.AppendUvarint(out, uint64(this.pageSize))
+	out = binary.AppendUvarint(out, c.seq)
+	out = binary.AppendUvarint(out, uint64(c.off))
+	out = binary.AppendUvarint(out, uint64(c.records))
+	out = append(out, c.last[:]...)
+	out = binary.AppendUvarint(out, uint64(c.next))
+	_, err = w.Write(out)
+	if err != nil {
+		return err
+	}
+
+	used := make([]uint64, (c.next+63)/64)
+	prev := ""
+	var e []byte
+	err = s.range_(this, func(k string, val value) error {
+		shared := 0
+		for shared < len(prev) && shared < len(k) && prev[shared] == k[shared] {
+			shared++
+		}
+		e = binary.AppendUvarint(e[:0], uint64(shared))
+		e = binary.AppendUvarint(e, val.Version)
+		e = val.record(k[shared:]).appendTo(e, false)
+		for _, page := range val.span(this.pageSize).pages() {
+			used[page/64] |= 1 << (page % 64)
+		}
+		prev = k
+		_, err := w.Write(binary.AppendUvarint(out[:0], uint64(len(e))))
+		if err == nil {
+			_, err = w.Write(e)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	out = binary.AppendUvarint(out[:0], 0)
+	out = binary.AppendUvarint(out, uint64(len(used)))
+	for _, word := range used {
+		out = binary.LittleEndian.AppendUint64(out, word)
+	}
+	_, err = w.Write(out)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		_, err = f.Write(binary.LittleEndian.AppendUint32(nil, h.Sum32()))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	this.m.Lock()
+	defer this.m.Unlock()
+	if gen != this.logGen {
+		this.logger("index.log was rewritten, dropping the checkpoint")
+		return os.Remove(fname + "~")
+	}
+	err = os.Rename(fname+"~", fname)
+	if err != nil {
+		return err
+	}
+	if c.off > this.ckptOff {
+		this.ckptOff = c.off
+	}
+	this.logger("checkpoint at offset %d of index.log", c.off)
+	return nil
+}
+
+// remove the checkpoint, before rewriting the log it refers to
+// must be called while holding the lock
+func (this *DB) dropCheckpoint() error {
+	this.logGen++
+	this.ckptOff = 0
+	err := os.Remove(filepath.Join(this.dir, ckptName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// load the checkpoint in the trie, and mark its pages in used
+// returns an error wrapping os.ErrNotExist if there is no checkpoint
+func (this *DB) loadCheckpoint(lenPages int64, used []uint64) (checkpoint, error) {
+	f, err := os.Open(filepath.Join(this.dir, ckptName))
+	if err != nil {
+		return checkpoint{}, err
+	}
+	defer f.Close()
+	return readCheckpoint(f, this.pageSize, lenPages, used, this.checkLog, func(rec record) {
+		if rec.Class > 0 {
+			this.markSlot(rec.val())
+		}
+		this.trie.Put(rec.Key, rec.val())
+	})
+}
+
+// read the checkpoint in f, calling check once the header is read, which can reject it, and cb for each key
+// the bitmap of the used pages is copied in used, which must have room for lenPages
+func readCheckpoint(f *os.File, pageSize int, lenPages int64, used []uint64, check func(checkpoint) error, cb func(record)) (c checkpoint, err error) {
+	fs, err := f.Stat()
+	if err != nil {
+		return c, err
+	}
+	if fs.Size() < int64(len(ckptMagic))+4 {
+		return c, fmt.Errorf("checkpoint too short")
+	}
+	h := crc32.New(castagnoli)
+	r := bufio.NewReaderSize(io.TeeReader(io.LimitReader(f, fs.Size()-4), h), 1<<16)
+
+	magic := make([]byte, len(ckptMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil {
+		return c, err
+	}
+	if string(magic) != ckptMagic {
+		return c, fmt.Errorf("not a checkpoint: magic %q", magic)
+	}
+	var head [6]uint64
+	for i := range head {
+		if i == 5 {
+			_, err = io.ReadFull(r, c.last[:])
+			if err != nil {
+				return c, err
+			}
+		}
+		head[i], err = binary.ReadUvarint(r)
+		if err != nil {
+			return c, err
+		}
+	}
+	if head[0] != formatVersion || head[1] != uint64(pageSize) {
+		return c, fmt.Errorf("checkpoint has format %d and page size %d", head[0], head[1])
+	}
+	c.seq, c.off, c.records, c.next = head[2], int64(head[3]), int(head[4]), int(head[5])
+	if int64(c.next) > lenPages {
+		return c, fmt.Errorf("checkpoint refers to page %d, but data.db has %d pages", c.next, lenPages)
+	}
+	err = check(c)
+	if err != nil {
+		return c, err
+	}
+
+	prev := ""
+	var e []byte
+	for {
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return c, err
+		}
+		if l == 0 {
+			break
+		}
+		if l > uint64(fs.Size()) {
+			return c, fmt.Errorf("invalid entry of %d bytes", l)
+		}
+		if uint64(cap(e)) < l {
+			e = make([]byte, l)
+		}
+		e = e[:l]
+		_, err = io.ReadFull(r, e)
+		if err != nil {
+			return c, err
+		}
+		d := decoder{buf: e}
+		shared := d.uvarint()
+		version := d.uvarint()
+		rec := d.record()
+		if d.err == nil && len(d.buf) > 0 {
+			d.err = fmt.Errorf("%d extra bytes", len(d.buf))
+		}
+		if d.err != nil {
+			return c, fmt.Errorf("after %q: %w", prev, d.err)
+		}
+		if shared > uint64(len(prev)) {
+			return c, fmt.Errorf("after %q: invalid prefix %d", prev, shared)
+		}
+		if end := rec.val().span(pageSize).end(); end > c.next {
+			return c, fmt.Errorf("checkpoint refers to page %d, but the next page is %d", end-1, c.next)
+		}
+		rec.Key = prev[:shared] + rec.Key
+		rec.Version = version
+		cb(rec)
+		prev = rec.Key
+	}
+
+	words, err := binary.ReadUvarint(r)
+	if err != nil {
+		return c, err
+	}
+	if words != uint64(c.next+63)/64 {
+		return c, fmt.Errorf("invalid bitmap of %d words for %d pages", words, c.next)
+	}
+	var word [8]byte
+	for i := uint64(0); i < words; i++ {
+		_, err = io.ReadFull(r, word[:])
+		if err != nil {
+			return c, err
+		}
+		used[i] = binary.LittleEndian.Uint64(word[:])
+	}
+
+	_, err = r.Peek(1)
+	if err != io.EOF {
+		return c, fmt.Errorf("extra data at the end of the checkpoint")
+	}
+	_, err = io.ReadFull(f, word[:4])
+	if err != nil {
+		return c, err
+	}
+	if h.Sum32() != binary.LittleEndian.Uint32(word[:4]) {
+		return c, fmt.Errorf("checkpoint has a bad checksum")
+	}
+	return c, nil
+}
+
+// check the log entry before the checkpoint offset is the one the checkpoint was taken after
+func (this *DB) checkLog(c checkpoint) error {
+	if c.off == 0 {
+		return nil
+	}
+	start := c.off - frameHeader - int64(binary.LittleEndian.Uint32(c.last[0:4]))
+	if start < 0 {
+		return errStale
+	}
+	fs, err := this.log.Stat()
+	if err != nil || fs.Size() < c.off {
+		return errStale
+	}
+	var header [frameHeader]byte
+	_, err = this.log.ReadAt(header[:], start)
+	if err != nil || !bytes.Equal(header[:], c.last[:]) {
+		return errStale
+	}
+	return nil
+}
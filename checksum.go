@@ -0,0 +1,60 @@
+package goblin
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+// returned when a value doesn't match its checksum
+type ErrCorrupt struct {
+	Key      string
+	Extents  []Extent // the pages of the value
+	Expected uint32
+	Actual   uint32
+	Offset   int // where the value starts in data.db, useful when it's in a slot
+}
+
+func (this ErrCorrupt) Error() string {
+	return fmt.Sprintf("corrupted value for %q in pages %v at offset %d: crc %08x, expected %08x",
+		this.Key, this.Extents, this.Offset, this.Actual, this.Expected)
+}
+
+// check the data read for key matches the checksum in the record, if any
+func (this value) verify(key string, data []byte, pageSize int) error {
+	if !this.HasCRC {
+		return nil // written before checksums
+	}
+	sum := checksum(data)
+	if sum != this.CRC {
+		return this.corrupt(key, sum, pageSize)
+	}
+	return nil
+}
+
+// the error for this value, when its data has checksum sum
+func (this value) corrupt(key string, sum uint32, pageSize int) ErrCorrupt {
+	off := 0
+	switch {
+	case this.Class > 0:
+		off = this.Slot * this.Class
+	case len(this.Extents) > 0:
+		off = this.Extents[0].Start * pageSize
+	}
+	return ErrCorrupt{key, this.span(pageSize), this.CRC, sum, off}
+}
+
+// read the value for key and verify it
+func (this *DB) load(key string, val value) ([]byte, error) {
+	data := this.fetch(val)
+	err := val.verify(key, data, this.pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
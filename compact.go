@@ -0,0 +1,201 @@
+package goblin
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// the compaction was stopped by Close
+var errStopped = errors.New("stopped")
+
+// the progress of the log compaction
+type Compaction struct {
+	Running bool
+	Done    int   // live keys written so far by the running compaction
+	Total   int   // live keys when the running compaction started
+	Runs    int   // compactions completed since open
+	Err     error // of the last compaction, if it failed
+}
+
+func (this *DB) Compaction() Compaction {
+	this.m.Lock()
+	defer this.m.Unlock()
+	return Compaction{
+		Running: this.compacting,
+		Done:    int(this.cpDone.Load()),
+		Total:   this.cpTotal,
+		Runs:    this.cpRuns,
+		Err:     this.cpErr,
+	}
+}
+
+// rebuild the log and drop old entries
+// writers are only blocked while switching to the new log
+func (this *DB) Optimize() error {
+	return this.compact()
+}
+
+// start a compaction in background if the log has too many stale records
+// must be called while holding the lock
+func (this *DB) autoCompact() {
+	if this.opts.CompactRatio < 0 || this.compacting || this.closing.Load() {
+		return
+	}
+	if float64(this.logRecords) <= float64(this.trie.Count())*(1+this.opts.CompactRatio)+10 {
+		return
+	}
+	this.compacting = true
+	this.cpWG.Add(1)
+	go func() {
+		defer this.cpWG.Done()
+		err := this.compact()
+		if err != nil && err != errStopped {
+			this.logger("can't compact: %v", err)
+		}
+	}()
+}
+
+// write the live records of a snapshot in a new log, then copy the entries logged in the meantime,
+// and switch to it
+func (this *DB) compact() (err error) {
+	this.cpm.Lock()
+	defer this.cpm.Unlock()
+
+	this.m.Lock()
+	this.compacting = true
+	s := this.snapshot_()
+	pos := this.logOff
+	this.cpTotal = this.trie.Count()
+	this.cpDone.Store(0)
+	this.m.Unlock()
+	this.logger("compacting %d keys", this.cpTotal)
+
+	defer func() {
+		this.release(s)
+		this.m.Lock()
+		this.compacting = false
+		this.cpErr = err
+		if err == nil {
+			this.cpRuns++
+		}
+		this.m.Unlock()
+	}()
+
+	tmp := this.logname + "~"
+	newlog, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, this.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	abort := func(err error) error {
+		_ = newlog.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	w := bufio.NewWriterSize(newlog, 1<<16)
+	var off int64
+	var records int
+	var last []byte
+	write := func(f []byte, n int) error {
+		off += int64(len(f))
+		records += n
+		last = f
+		_, err := w.Write(f)
+		return err
+	}
+
+	// the first entry keeps track of the last version, in case the newest records were deleted
+	err = write(frame(record{Deleted: true, Version: s.seq}.encode()), 1)
+	if err != nil {
+		return abort(err)
+	}
+	t := time.Now().Add(time.Second)
+	err = s.range_(this, func(k string, v value) error {
+		if this.closing.Load() {
+			return errStopped
+		}
+		if now := time.Now(); now.After(t) {
+			t = now.Add(time.Second)
+			this.logger("compacting %q...", k)
+		}
+		this.cpDone.Add(1)
+		// only live keys are written, so tombstones are dropped here
+		return write(frame(v.record(k).encode()), 1)
+	})
+	if err != nil {
+		return abort(err)
+	}
+
+	// catch up with the entries logged in the meantime, the last bit while holding the lock
+	for {
+		this.m.Lock()
+		end := this.logOff
+		if end-pos < 1<<20 || this.closing.Load() {
+			break
+		}
+		this.m.Unlock()
+		err = this.copyLog(pos, end, write)
+		if err != nil {
+			return abort(err)
+		}
+		pos = end
+	}
+	defer this.m.Unlock()
+	if this.closing.Load() {
+		return abort(errStopped)
+	}
+	err = this.copyLog(pos, this.logOff, write)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = newlog.Sync()
+	}
+	if err == nil {
+		err = this.dropCheckpoint()
+	}
+	if err == nil {
+		err = os.Rename(tmp, this.logname)
+	}
+	if err != nil {
+		return abort(err)
+	}
+	_ = this.log.Close()
+	this.log = newlog
+	this.logOff, this.logRecords = off, records
+	copy(this.logLast[:], last)
+	this.logger("compacted index.log, %d records", records)
+	return nil
+}
+
+// pass the entries of the log between from and to to write, with the number of records in each
+func (this *DB) copyLog(from, to int64, write func([]byte, int) error) error {
+	r := bufio.NewReaderSize(io.NewSectionReader(this.log, from, to-from), 1<<16)
+	for off := from; off < to; {
+		f := make([]byte, frameHeader)
+		_, err := io.ReadFull(r, f)
+		if err != nil {
+			return fmt.Errorf("can't read index.log at offset %d: %w", off, err)
+		}
+		f = append(f, make([]byte, binary.LittleEndian.Uint32(f[0:4]))...)
+		_, err = io.ReadFull(r, f[frameHeader:])
+		if err != nil {
+			return fmt.Errorf("can't read index.log at offset %d: %w", off, err)
+		}
+		entry, err := decode(f[frameHeader:])
+		if err != nil {
+			return fmt.Errorf("index.log is corrupted at offset %d: %w", off, err)
+		}
+		err = write(f, len(entry.entries()))
+		if err != nil {
+			return err
+		}
+		off += int64(len(f))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package goblin_test
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ohait/goblin"
+)
+
+func TestCompact(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.Open("/tmp/test-goblin/", goblin.Options{CompactRatio: 2})
+	noError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		noError(t, db.Store(fmt.Sprintf("key-%04d", i), []byte(fmt.Sprint(i))))
+	}
+
+	// keep writing while the log gets compacted
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := fmt.Sprintf("key-%04d", (i*4+w)%1000)
+				noError(t, db.Store(k, []byte(fmt.Sprint(w))))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Compaction().Running || db.Compaction().Runs == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no compaction: %+v", db.Compaction())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c := db.Compaction()
+	t.Logf("compaction: %+v", c)
+	noError(t, c.Err)
+
+	check := func(db *goblin.DB) {
+		t.Helper()
+		if db.Size() != 1000 {
+			t.Fatalf("expected 1000 keys, got %d", db.Size())
+		}
+		for i := 0; i < 1000; i++ {
+			x, err := db.Fetch(fmt.Sprintf("key-%04d", i))
+			noError(t, err)
+			if string(x) != fmt.Sprint(i%4) {
+				t.Fatalf("expected %d for key-%04d, got %q", i%4, i, x)
+			}
+		}
+	}
+	check(db)
+	noError(t, db.Close())
+
+	db, err = goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	defer db.Close()
+	check(db)
+}
+
+func TestCompactClose(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	for i := 0; i < 10000; i++ {
+		noError(t, db.Store(fmt.Sprint(i%100), []byte(fmt.Sprint(i))))
+	}
+	// whether a compaction is running or not, Close waits for it or stops it
+	noError(t, db.Close())
+
+	db, err = goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	defer db.Close()
+	if db.Size() != 100 {
+		t.Fatalf("expected 100 keys, got %d", db.Size())
+	}
+	x, err := db.Fetch("99")
+	noError(t, err)
+	if string(x) != "9999" {
+		t.Fatalf("expected 9999, got %q", x)
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/ohait/goblin"
+	"github.com/ohait/goblin/trie"
 )
 
 func TestConc(t *testing.T) {
@@ -19,6 +22,7 @@ func TestConc(t *testing.T) {
 	_ = os.RemoveAll("/tmp/test-goblin")
 	db, err := goblin.New("/tmp/test-goblin/")
 	noError(t, err)
+	defer db.Close()
 	t.Logf("init %+v", db)
 
 	var wg sync.WaitGroup
@@ -54,3 +58,142 @@ func testConc(t *testing.T, db *goblin.DB) {
 		noError(t, err)
 	}
 }
+
+// readers don't wait for the writers, and never see a value being overwritten
+func TestConcReads(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.Open("/tmp/test-goblin/", goblin.Options{InitialSize: 4096})
+	noError(t, err)
+	defer db.Close()
+
+	// each value is a single byte repeated, so a torn read is easy to spot
+	value := func(i, round int) []byte {
+		return bytes.Repeat([]byte{byte('a' + round%26)}, 50+i*7%1000)
+	}
+	for i := 0; i < 100; i++ {
+		noError(t, db.Store(fmt.Sprint(i), value(i, 0)))
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for round := 1; round < 50; round++ {
+				for i := w; i < 100; i += 2 {
+					noError(t, db.Store(fmt.Sprint(i), value(i, round)))
+				}
+			}
+		}(w)
+	}
+	check := func(k string, x []byte) bool {
+		i, _ := strconv.Atoi(k)
+		if len(x) != len(value(i, 0)) || len(bytes.Trim(x, string(x[:1]))) != 0 {
+			t.Errorf("torn read of %d: %q", i, x)
+			return false
+		}
+		return true
+	}
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if r%2 == 1 {
+					// the pairs are fetched after the range has read their value
+					err := db.Range(func(p goblin.Pair) error {
+						x, err := p.Fetch()
+						if err != nil {
+							return err
+						}
+						if !check(p.Key, x) {
+							return trie.EOD
+						}
+						return nil
+					})
+					noError(t, err)
+					continue
+				}
+				for i := 0; i < 100; i++ {
+					x, err := db.Fetch(fmt.Sprint(i))
+					noError(t, err)
+					if !check(fmt.Sprint(i), x) {
+						return
+					}
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	t.Logf("%v", db)
+}
+
+func benchFetch(b *testing.B, writers int) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	data := long(1000)
+	for i := 0; i < 1000; i++ {
+		_ = db.Store(fmt.Sprint(i), data)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var writes atomic.Int64
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				_ = db.Store(fmt.Sprint(i%1000), data)
+				writes.Add(1)
+			}
+		}(w)
+	}
+
+	b.ResetTimer()
+	b.SetBytes(int64(len(data)))
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			_, err := db.Fetch(fmt.Sprint(i % 1000))
+			if err != nil {
+				b.Error(err)
+			}
+			i += 7
+		}
+	})
+	b.StopTimer()
+	close(done)
+	wg.Wait()
+	b.ReportMetric(float64(writes.Load())/b.Elapsed().Seconds(), "writes/s")
+}
+
+func BenchmarkFetch(b *testing.B) {
+	benchFetch(b, 0)
+}
+
+// read throughput while the values are being overwritten
+func BenchmarkFetchWriting(b *testing.B) {
+	benchFetch(b, 2)
+}
@@ -0,0 +1,51 @@
+package goblin
+
+import "github.com/ohait/goblin/trie"
+
+// A position in the DB, which can be moved back and forth, or resumed later with Seek
+// it only keeps the current key, so concurrent changes are seen as they happen
+type Cursor struct {
+	db *DB
+	c  *trie.Cursor[value]
+}
+
+func (this *DB) Cursor() *Cursor {
+	return &Cursor{this, this.trie.Cursor()}
+}
+
+func (this *Cursor) pair(k string, val *value) (Pair, bool) {
+	if val == nil {
+		return Pair{}, false
+	}
+	return val.pair(k, this.db), true
+}
+
+// the current pair, false if the cursor is not positioned
+func (this *Cursor) Current() (Pair, bool) {
+	return this.pair(this.c.Current())
+}
+
+// move to the first key, false if the DB is empty
+func (this *Cursor) First() (Pair, bool) {
+	return this.pair(this.c.First())
+}
+
+// move to the last key, false if the DB is empty
+func (this *Cursor) Last() (Pair, bool) {
+	return this.pair(this.c.Last())
+}
+
+// move to the first key equal or after k, false if there is none
+func (this *Cursor) Seek(k string) (Pair, bool) {
+	return this.pair(this.c.Seek(k))
+}
+
+// move to the next key, false if there is none
+func (this *Cursor) Next() (Pair, bool) {
+	return this.pair(this.c.Next())
+}
+
+// move to the previous key, false if there is none
+func (this *Cursor) Prev() (Pair, bool) {
+	return this.pair(this.c.Prev())
+}
@@ -0,0 +1,140 @@
+package goblin
+
+import (
+	"fmt"
+	"time"
+)
+
+// move the values toward the front of data.db, then shrink it
+// writers are only blocked while each group of values is moved
+// pages still used by open transactions can't be released, and may keep the file larger
+func (this *DB) Defrag() error {
+	t0 := time.Now()
+
+	// if there were no holes, all the used pages would be before limit
+	this.m.Lock()
+	limit := this.next - this.unused.len()
+	this.m.Unlock()
+
+	var keys []string
+	_ = this.trie.Range(func(k string, v value) error {
+		if v.span(this.pageSize).end() > limit {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+
+	moved := 0
+	for len(keys) > 0 {
+		n := 256
+		if n > len(keys) {
+			n = len(keys)
+		}
+		ct, full, err := this.move(keys[:n], limit)
+		if err != nil {
+			return err
+		}
+		moved += ct
+		if full {
+			break
+		}
+		keys = keys[n:]
+	}
+
+	err := this.shrink()
+	if err != nil {
+		return err
+	}
+	this.logger("defragmented data.db in %v, %d values moved: %v", time.Since(t0), moved, this)
+	return nil
+}
+
+// copy the values of keys which are beyond limit in free pages before it, and log them as one batch
+// the values keep their versions
+// return how many were moved, and true if there are no more free pages before limit
+func (this *DB) move(keys []string, limit int) (int, bool, error) {
+	this.m.Lock()
+	defer this.m.Unlock()
+
+	full := false
+	group := record{}
+	release := func() {
+		for _, r := range group.Batch {
+			this.dispose(r.val())
+		}
+	}
+	for _, k := range keys {
+		val := this.trie.Get(k)
+		if val == nil || val.span(this.pageSize).end() <= limit {
+			continue // changed in the meantime
+		}
+		data := this.read(*val)
+		err := val.verify(k, data, this.pageSize)
+		if err != nil {
+			this.logger("not moving %q: %v", k, err)
+			continue
+		}
+		var r record
+		if val.Class > 0 {
+			slot, err := this.allocSlot(val.Class, val.Size, limit)
+			if err == ErrFull {
+				full = true
+				break
+			}
+			r = this.placeSlot(k, data, val.Class, slot)
+		} else {
+			pages := this.unused.take(val.Extents.count(), limit)
+			if pages == nil {
+				full = true
+				break
+			}
+			r = this.place(k, data, pages)
+		}
+		r.Version = val.Version
+		group.Batch = append(group.Batch, r)
+	}
+	if len(group.Batch) == 0 {
+		return 0, full, nil
+	}
+
+	group.Version = this.seq + 1
+	err := this.writeLog(group)
+	if err != nil {
+		release()
+		return 0, false, err
+	}
+	this.commit(group)
+	return len(group.Batch), full, nil
+}
+
+// truncate data.db after the last page in use
+func (this *DB) shrink() error {
+	this.m.Lock()
+	defer this.m.Unlock()
+
+	this.next = this.unused.trim(this.next)
+	max := this.next
+	if max == 0 {
+		max = 1
+	}
+	if max >= this.max {
+		return nil
+	}
+
+	// the moved values must be on disk, before the pages they left are gone
+	err := this.sync()
+	if err != nil {
+		return err
+	}
+	err = this.remmap(max * this.pageSize)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+	err = this.data.Truncate(int64(max * this.pageSize))
+	if err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+	this.max = max
+	this.logger("shrink to %s", mb(max*this.pageSize))
+	return nil
+}
@@ -0,0 +1,109 @@
+package goblin_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ohait/goblin"
+)
+
+func TestDefrag(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		noError(t, db.Store(fmt.Sprintf("key-%04d", i), long(1000+i)))
+	}
+	_, v0, err := db.FetchVersion("key-0999")
+	noError(t, err)
+	for i := 0; i < 900; i++ {
+		noError(t, db.Delete(fmt.Sprintf("key-%04d", i)))
+	}
+	fs, err := os.Stat("/tmp/test-goblin/data.db")
+	noError(t, err)
+	size0 := fs.Size()
+
+	// a transaction keeps seeing what was there before
+	err = db.View(func(tx *goblin.Tx) error {
+		noError(t, db.Defrag())
+		x, err := tx.Fetch("key-0950")
+		noError(t, err)
+		if string(x) != string(long(1950)) {
+			t.Fatalf("expected long(1950), got %d bytes", len(x))
+		}
+		return nil
+	})
+	noError(t, err)
+	noError(t, db.Defrag())
+
+	fs, err = os.Stat("/tmp/test-goblin/data.db")
+	noError(t, err)
+	t.Logf("data.db: %d -> %d, %v", size0, fs.Size(), db)
+	if fs.Size() > size0/5 {
+		t.Fatalf("data.db didn't shrink: %d -> %d", size0, fs.Size())
+	}
+
+	check := func(db *goblin.DB) {
+		t.Helper()
+		if db.Size() != 100 {
+			t.Fatalf("expected 100 keys, got %d", db.Size())
+		}
+		for i := 900; i < 1000; i++ {
+			x, err := db.Fetch(fmt.Sprintf("key-%04d", i))
+			noError(t, err)
+			if string(x) != string(long(1000+i)) {
+				t.Fatalf("expected long(%d) for key-%04d, got %d bytes", 1000+i, i, len(x))
+			}
+		}
+		// moving a value doesn't change its version
+		_, v, err := db.FetchVersion("key-0999")
+		noError(t, err)
+		if v != v0 {
+			t.Fatalf("expected version %d, got %d", v0, v)
+		}
+	}
+	check(db)
+	noError(t, db.Store("new", long(5000)))
+	noError(t, db.Delete("new"))
+	check(db)
+	noError(t, db.Close())
+
+	// the log still has the old records, which refer to pages which are gone
+	noError(t, os.Remove("/tmp/test-goblin/index.ckpt"))
+	db, err = goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	check(db)
+	noError(t, db.Close())
+
+	report, err := goblin.Verify("/tmp/test-goblin/")
+	noError(t, err)
+	if !report.OK() {
+		t.Fatalf("verify: %v", report)
+	}
+}
+
+// moving the values read or written by an update is not a conflict
+func TestDefragUpdate(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	defer db.Close()
+
+	noError(t, db.Store("a", long(5000)))
+	noError(t, db.Store("b", long(5000)))
+	noError(t, db.Delete("a")) // so Defrag moves b to the front
+	err = db.Update(func(tx *goblin.Tx) error {
+		_, err := tx.Fetch("b")
+		noError(t, err)
+		noError(t, db.Defrag())
+		return tx.Store("b", long(100))
+	})
+	noError(t, err)
+	x, err := db.Fetch("b")
+	noError(t, err)
+	if string(x) != string(long(100)) {
+		t.Fatalf("expected long(100), got %d bytes", len(x))
+	}
+}
@@ -0,0 +1,65 @@
+package goblin
+
+// readers don't take the lock: they pin the current epoch while they look up a value and copy it
+// the values replaced meanwhile are kept in the pending list, and their space is not reused until all the readers
+// pinned before are done, i.e. until the epoch has advanced twice
+// only the writers advance the epoch, and only when nobody is pinned to the previous one
+
+// pin the current epoch, pass it to unpin when done
+func (this *DB) pin() uint64 {
+	for {
+		e := this.epoch.Load()
+		this.pins[e%2].Add(1)
+		if this.epoch.Load() == e {
+			return e
+		}
+		this.pins[e%2].Add(-1) // advanced in the meantime, try again
+	}
+}
+
+func (this *DB) unpin(e uint64) {
+	this.pins[e%2].Add(-1)
+}
+
+// true if some reader may be using a value it looked up
+func (this *DB) pinned() bool {
+	return this.pins[0].Load() != 0 || this.pins[1].Load() != 0
+}
+
+// give back the space of the pending values that no snapshot and no reader can see anymore
+// must be called while holding the lock
+func (this *DB) reclaim() {
+	if len(this.pending) == 0 {
+		return
+	}
+	for i := 0; i < 2; i++ {
+		e := this.epoch.Load()
+		if this.pins[(e+1)%2].Load() != 0 {
+			break // someone is still pinned to the previous epoch
+		}
+		this.epoch.Store(e + 1)
+	}
+	epoch := this.epoch.Load()
+
+	// pages freed after the oldest snapshot must be kept
+	min := this.seq
+	for s := range this.snaps {
+		if s.seq < min {
+			min = s.seq
+		}
+	}
+	// the pending values are in order of seq and epoch, so the ones which can go are at the beginning
+	n := 0
+	var freed extents
+	for ; n < len(this.pending); n++ {
+		f := this.pending[n]
+		if f.seq > min || f.epoch+2 > epoch {
+			break
+		}
+		freed = append(freed, this.dispose(f.val)...)
+	}
+	if n > 0 {
+		this.pending = append(this.pending[:0], this.pending[n:]...)
+		this.autoPunch(freed)
+	}
+}
@@ -2,4 +2,4 @@ module github.com/ohait/goblin
 
 go 1.20
 
-require golang.org/x/sys v0.11.0 // indirect
+require golang.org/x/sys v0.11.0
@@ -4,11 +4,11 @@ package goblin
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sync"
+	"sync/atomic"
 
 	"github.com/ohait/goblin/trie"
 	"golang.org/x/sys/unix"
@@ -18,37 +18,92 @@ var Logger = func(f string, args ...any) {}
 
 type DB struct {
 	m        sync.Mutex
+	opts     Options
+	logger   func(f string, args ...any)
 	dir      string
 	dataname string
 	data     *os.File
 	logname  string
 	log      *os.File
 
-	trie trie.Trie[[]int]
+	trie trie.Trie[value]
 
 	pageSize int
 	mmap     []byte
-	unused   []int // pages that can be used
-	next     int   // next new page
-	max      int   // max page
+	unused   freeList // pages that can be used
+	next     int      // next new page
+	max      int      // max page
+	freed    int      // pages freed since the last holes were punched
+	toPunch  extents  // pages freed which may need a hole punched
+	noPunch  bool     // punching holes is not supported
+
+	classes   map[int]*sizeClass // small values are in slots, by slot size
+	slotSpace int                // bytes of the used slots
+	slotBytes int                // bytes of the values in them
+
+	seq     uint64                 // number of commits so far
+	snaps   map[*snapshot]struct{} // open snapshots
+	pending []freed                // pages released while some snapshot or reader may still read them
+	readers map[loc]*opened        // values open by a Reader
+	epoch   atomic.Uint64          // see pin()
+	pins    [2]atomic.Int64        // readers pinned to even and odd epochs
+	mm      sync.RWMutex           // held by readers while copying from the mmap, and by remmap to replace it
+	bm      sync.Mutex             // protects held
+	held    map[*byte]*mapping     // mappings in use by Borrow, by their first byte
+	txm     sync.Mutex             // only one Update at the time
+
+	indexes map[string]*index // secondary indexes
+
+	logOff     int64             // end of index.log
+	logRecords int               // records in index.log
+	logLast    [frameHeader]byte // header of the last entry in index.log
+	logGen     int               // incremented when index.log is rewritten
+	ckptOff    int64             // offset of the last checkpoint
+	ckptBusy   bool              // a checkpoint is being written in background
+	ckptWG     sync.WaitGroup
+	ckm        sync.Mutex // one checkpoint at the time
+
+	compacting bool       // the log is being compacted
+	cpm        sync.Mutex // one compaction at the time
+	cpWG       sync.WaitGroup
+	cpDone     atomic.Int64
+	cpTotal    int
+	cpRuns     int
+	cpErr      error
+	closing    atomic.Bool
 }
 
 func (this *DB) String() string {
-	return fmt.Sprintf("{%d keys, %d+%d free pages, %s data}",
-		this.trie.Count(), len(this.unused), this.max-this.next, mb(this.max*this.pageSize))
+	this.m.Lock()
+	defer this.m.Unlock()
+	waste := 0.0
+	if this.slotSpace > 0 {
+		waste = 1 - float64(this.slotBytes)/float64(this.slotSpace)
+	}
+	return fmt.Sprintf("{%d keys, %d+%d free pages, %s data, %s in slots with %.0f%% waste}",
+		this.trie.Count(), this.unused.len(), this.max-this.next, mb(this.max*this.pageSize), mb(this.slotSpace), waste*100)
 }
 
-// use the given directory as a DB.
+// use the given directory as a DB, with the default options
 // if missing, it's created
 // if empty, a new DB is created
 // NOTE: you can't use the same DB twice at the same time, not even on the same process
 func New(dir string) (*DB, error) {
-	var err error
+	return Open(dir, Options{})
+}
+
+// like New, but with the given options
+func Open(dir string, opts Options) (*DB, error) {
+	err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
 	this := &DB{
-		dir:      dir,
-		pageSize: 256,
+		dir:    dir,
+		opts:   opts,
+		logger: opts.Logger,
 	}
-	err = os.MkdirAll(dir, 0777)
+	err = os.MkdirAll(dir, opts.DirMode)
 	if err != nil {
 		return nil, fmt.Errorf("can't use %q: %w", dir, err)
 	}
@@ -56,40 +111,62 @@ func New(dir string) (*DB, error) {
 	this.dataname = filepath.Join(dir, "data.db")
 	this.logname = filepath.Join(dir, "index.log")
 
-	this.log, err = os.OpenFile(this.logname, os.O_RDWR|os.O_CREATE, 0666)
+	this.data, err = os.OpenFile(this.dataname, os.O_RDWR|os.O_CREATE, opts.FileMode)
 	if err != nil {
-		return nil, fmt.Errorf("can't open %q: %w", this.logname, err)
+		return nil, fmt.Errorf("can't open %q: %w", this.dataname, err)
 	}
 
-	this.data, err = os.OpenFile(this.dataname, os.O_RDWR|os.O_CREATE, 0666)
+	err = lock(this.data, opts.LockTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("can't open %q: %w", this.dataname, err)
+		_ = this.data.Close()
+		return nil, err
 	}
 
-	err = unix.Flock(int(this.data.Fd()), unix.LOCK_EX)
-	if err != nil {
-		return nil, fmt.Errorf("can't flock: %w", err)
+	fail := func(err error) (*DB, error) {
+		if this.mmap != nil {
+			_ = unix.Munmap(this.mmap)
+		}
+		if this.log != nil {
+			_ = this.log.Close()
+		}
+		_ = unix.Flock(int(this.data.Fd()), unix.LOCK_UN)
+		_ = this.data.Close()
+		return nil, err
 	}
 
 	s, _ := this.data.Stat()
 	fsize := s.Size()
+
+	err = this.loadMeta(fsize)
+	if err != nil {
+		return fail(err)
+	}
+
+	this.log, err = os.OpenFile(this.logname, os.O_RDWR|os.O_CREATE, opts.FileMode)
+	if err != nil {
+		return fail(fmt.Errorf("can't open %q: %w", this.logname, err))
+	}
+
 	if fsize == 0 {
-		err = this.data.Truncate(1 << 20) // 1MB
+		fsize = int64(opts.InitialSize / this.pageSize * this.pageSize)
+		if fsize < int64(this.pageSize) {
+			fsize = int64(this.pageSize)
+		}
+		err = this.data.Truncate(fsize)
 		if err != nil {
-			return nil, fmt.Errorf("can't create data file: %w", err)
+			return fail(fmt.Errorf("can't create data file: %w", err))
 		}
-		fsize = 1 << 20
 	}
 	err = this.remmap(int(fsize))
 	if err != nil {
-		return nil, fmt.Errorf("can't mmap: %w", err)
+		return fail(fmt.Errorf("can't mmap: %w", err))
 	}
 	this.max = int(fsize / int64(this.pageSize))
 	//log.Printf("mmap at %p, max pages: %d", this.mmap, this.max)
 
 	err = this.rewind()
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
 	runtime.SetFinalizer(this, func(obj any) {
 		obj.(*DB).Close()
@@ -100,30 +177,104 @@ func New(dir string) (*DB, error) {
 
 func (this *DB) Close() error {
 	defer runtime.SetFinalizer(this, nil)
+	this.closing.Store(true)
+	this.cpWG.Wait()
+	this.ckptWG.Wait()
+	this.m.Lock()
+	dirty := this.logOff != this.ckptOff
+	this.m.Unlock()
+	if this.opts.CheckpointEvery > 0 && dirty {
+		err := this.Checkpoint()
+		if err != nil {
+			this.logger("can't checkpoint: %v", err)
+		}
+	}
 	_ = this.Sync()
 	_ = this.log.Close()
-	_ = unix.Munmap(this.mmap)
+	this.mm.Lock()
+	_ = this.unmap(this.mmap)
+	this.mmap = nil
+	this.mm.Unlock()
 	_ = unix.Flock(int(this.data.Fd()), unix.LOCK_UN)
 	return this.data.Close()
 }
 
 // Key/Value pair with lazy value retrieval
 type Pair struct {
-	Key   string
-	sto   *DB
-	size  int
-	pages []int
+	Key     string
+	Version uint64
+	sto     *DB
+	val     value
+	kept    bool   // val is kept by a snapshot
+	data    []byte // when sto is nil, the value is already in memory
 }
 
-func (this Pair) Fetch() []byte {
-	return this.sto.fetch(this.size, this.pages)
+// read the value, and verify its checksum
+// if the key was changed after the pair was read, the current value is returned, or nil if deleted
+func (this Pair) Fetch() ([]byte, error) {
+	if this.sto == nil {
+		return this.data, nil
+	}
+	e := this.sto.pin()
+	defer this.sto.unpin(e)
+	val := this.current()
+	if val == nil {
+		return nil, nil
+	}
+	return this.sto.load(this.Key, *val)
+}
+
+// the pages of the value the pair was read with may be reused as soon as the key changes, unless a snapshot
+// keeps them, so the value is looked up again
+// must be called while pinned
+func (this Pair) current() *value {
+	if this.kept {
+		return &this.val
+	}
+	return this.sto.trie.Get(this.Key)
 }
 
 // range thru all the keys in lexicographic order, and return each as a Pair
 func (this *DB) Range(cb func(Pair) error) error {
-	return this.trie.Range(func(key string, record []int) error {
-		size, pages := (record)[0], (record)[1:]
-		return cb(Pair{key, this, size, pages})
+	return this.trie.Range(func(key string, val value) error {
+		return cb(val.pair(key, this))
+	})
+}
+
+// range thru the keys starting with prefix, in lexicographic order
+func (this *DB) RangePrefix(prefix string, cb func(Pair) error) error {
+	return this.trie.RangePrefix(prefix, func(key string, val value) error {
+		return cb(val.pair(key, this))
+	})
+}
+
+// range thru the keys from start (included) to end (excluded), in lexicographic order
+// if end is empty, there is no upper limit
+func (this *DB) RangeBetween(start, end string, cb func(Pair) error) error {
+	return this.trie.RangeBetween(start, end, func(key string, val value) error {
+		return cb(val.pair(key, this))
+	})
+}
+
+// range thru all the keys in reverse lexicographic order
+func (this *DB) RangeReverse(cb func(Pair) error) error {
+	return this.trie.RangeReverse(func(key string, val value) error {
+		return cb(val.pair(key, this))
+	})
+}
+
+// range thru the keys starting with prefix, in reverse lexicographic order
+func (this *DB) RangePrefixReverse(prefix string, cb func(Pair) error) error {
+	return this.trie.RangePrefixReverse(prefix, func(key string, val value) error {
+		return cb(val.pair(key, this))
+	})
+}
+
+// range thru the keys from end (excluded) down to start (included), in reverse lexicographic order
+// if end is empty, there is no upper limit
+func (this *DB) RangeBetweenReverse(start, end string, cb func(Pair) error) error {
+	return this.trie.RangeBetweenReverse(start, end, func(key string, val value) error {
+		return cb(val.pair(key, this))
 	})
 }
 
@@ -131,67 +282,275 @@ func (this *DB) Size() int {
 	return this.trie.Count()
 }
 
+// how many keys start with prefix
+func (this *DB) CountPrefix(prefix string) int {
+	return this.trie.CountPrefix(prefix)
+}
+
+// how many keys are between start (included) and end (excluded)
+// if end is empty, there is no upper limit
+func (this *DB) CountRange(start, end string) int {
+	return this.trie.CountRange(start, end)
+}
+
+// how many keys come before key, in lexicographic order
+func (this *DB) Rank(key string) int {
+	return this.trie.Rank(key)
+}
+
+// the pair at position i in lexicographic order, false if out of range
+func (this *DB) Nth(i int) (Pair, bool) {
+	k, val := this.trie.Nth(i)
+	if val == nil {
+		return Pair{}, false
+	}
+	return val.pair(k, this), true
+}
+
 func (this *DB) Fetch(key string) ([]byte, error) {
+	data, _, err := this.FetchVersion(key)
+	return data, err
+}
+
+// like Fetch, but also return the version of the value, which is 0 if missing
+func (this *DB) FetchVersion(key string) ([]byte, uint64, error) {
 	//Logger("fetch %q", key)
-	record := this.trie.Get(key)
-	if record == nil {
-		Logger("not found %q", key)
-		return nil, nil
+	e := this.pin()
+	defer this.unpin(e)
+	val := this.trie.Get(key)
+	if val == nil {
+		this.logger("not found %q", key)
+		return nil, 0, nil
 	}
-	size, pages := (*record)[0], (*record)[1:]
-	Logger("found key %q: size: %d, pages: %v", key, size, pages)
+	this.logger("found key %q: version: %d, size: %d, extents: %v", key, val.Version, val.Size, val.Extents)
 
-	return this.fetch(size, pages), nil
+	data, err := this.load(key, *val)
+	return data, val.Version, err
 }
 
 func (this *DB) Store(key string, data []byte) error {
 	this.m.Lock()
 	defer this.m.Unlock()
+	return this.store(key, data)
+}
+
+// returned by StoreIf when the version doesn't match
+type ErrConflict struct {
+	Key      string
+	Expected uint64
+	Actual   uint64
+}
+
+func (this ErrConflict) Error() string {
+	return fmt.Sprintf("conflict on %q: expected version %d, found %d", this.Key, this.Expected, this.Actual)
+}
+
+// store the data only if the current version of key is the expected one, otherwise return ErrConflict
+// use 0 to store only if the key doesn't exist
+func (this *DB) StoreIf(key string, data []byte, expected uint64) error {
+	this.m.Lock()
+	defer this.m.Unlock()
+
+	var actual uint64
+	if val := this.trie.Get(key); val != nil {
+		actual = val.Version
+	}
+	if actual != expected {
+		return ErrConflict{key, expected, actual}
+	}
+	return this.store(key, data)
+}
+
+// must be called while holding the lock
+func (this *DB) store(key string, data []byte) error {
+	record, err := this.alloc(key, data)
+	if err != nil {
+		return err
+	}
+	record.Version = this.seq + 1
+
+	err = this.writeLog(record)
+	if err != nil {
+		this.dispose(record.val())
+		return err
+	}
+
+	this.commit(record)
+	return nil
+}
+
+// remove the key from the DB, and release its pages
+// a tombstone is written to the log, so the key will not reappear on restart
+// deleting a missing key is a no-op
+func (this *DB) Delete(key string) error {
+	this.m.Lock()
+	defer this.m.Unlock()
+
+	if this.trie.Get(key) == nil {
+		return nil
+	}
+
+	record := record{Key: key, Deleted: true, Version: this.seq + 1}
+	err := this.writeLog(record)
+	if err != nil {
+		return err
+	}
+	this.commit(record)
+	return nil
+}
 
+// copy the data in free pages, and return the record pointing to them
+// must be called while holding the lock
+func (this *DB) alloc(key string, data []byte) (record, error) {
+	if len(data) > 0 && len(data) <= this.opts.InlineSize {
+		return record{Key: key, Size: len(data), Inline: append([]byte{}, data...), data: data}, nil
+	}
+	if class := this.class(len(data)); class > 0 {
+		slot, err := this.allocSlot(class, len(data), -1)
+		if err != nil {
+			this.logger("grow error: %v", err)
+			return record{}, err
+		}
+		return this.placeSlot(key, data, class, slot), nil
+	}
+	pages, err := this.allocPages((len(data) + this.pageSize - 1) / this.pageSize)
+	if err != nil {
+		this.logger("grow error: %v", err)
+		return record{}, err
+	}
+	return this.place(key, data, pages), nil
+}
+
+// copy the data in the given pages, and return the record pointing to them
+// must be called while holding the lock
+func (this *DB) place(key string, data []byte, pages extents) record {
+	sum := checksum(data)
 	record := record{
-		Key:  key,
-		Size: len(data),
-	}
-	for len(data) > 0 {
-		var page int
-		if len(this.unused) > 0 {
-			page, this.unused = this.unused[0], this.unused[1:]
-			//Logger("using unused: %d", page)
+		Key:     key,
+		Size:    len(data),
+		Extents: pages,
+		CRC:     &sum,
+		data:    data,
+	}
+	this.write(data, pages)
+	return record
+}
+
+// copy the data in the given pages, one run at the time
+// must be called while holding the lock
+func (this *DB) write(data []byte, pages extents) {
+	for _, e := range pages {
+		ct := copy(this.mmap[e.Start*this.pageSize:e.end()*this.pageSize], data)
+		//Logger("stored %d in %v (%q)", ct, e, string(data[:ct]))
+		data = data[ct:]
+	}
+}
+
+// copy the data in the given slot, and return the record pointing to it
+// must be called while holding the lock
+func (this *DB) placeSlot(key string, data []byte, class, slot int) record {
+	sum := checksum(data)
+	copy(this.mmap[slot*class:], data)
+	return record{
+		Key:   key,
+		Size:  len(data),
+		Class: class,
+		Slot:  slot,
+		CRC:   &sum,
+		data:  data,
+	}
+}
+
+// find n free pages, as a contiguous run if possible: the first free run long enough, or the end of the file,
+// growing it if needed
+// only if data.db can't grow, the pages can be scattered
+// must be called while holding the lock
+func (this *DB) allocPages(n int) (extents, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	if out := this.unused.takeRun(n, this.next); out != nil {
+		return out, nil
+	}
+	for {
+		// a free run at the end can be extended with new pages
+		start := this.next
+		if l := len(this.unused.list); l > 0 && this.unused.list[l-1].end() == this.next {
+			start = this.unused.list[l-1].Start
+		}
+		if start+n <= this.max {
+			this.unused.trim(this.next)
+			this.next = start + n
+			return extents{{start, n}}, nil
+		}
+		err := this.grow()
+		if err == ErrFull {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	this.unused.put(extents{{this.next, this.max - this.next}})
+	this.next = this.max
+	out := this.unused.take(n, this.max)
+	if out == nil {
+		return nil, ErrFull
+	}
+	return out, nil
+}
+
+// update the trie with the given record (or batch), and put the old pages in the free list
+// must be called while holding the lock, after the record has been logged
+func (this *DB) commit(r record) {
+	this.seq = r.Version
+	for _, r := range r.entries() {
+		this.remember(r.Key)
+		var old *value
+		if r.Deleted {
+			old = this.trie.Remove(r.Key)
 		} else {
-			//Logger("using next: %d, max: %d", this.next, this.max)
-			if this.next == this.max {
-				err := this.grow()
-				if err != nil {
-					log.Printf("grow error: %v", err)
-					return err
-				}
-			}
-			page = this.next
-			this.next++
+			old = this.trie.Put(r.Key, r.val())
+		}
+		if old != nil {
+			//Logger("now unused: %v", old.Extents)
+			this.free(*old)
+		}
+		for _, idx := range this.indexes {
+			idx.update(r.Key, r.data, r.Deleted)
 		}
-		record.Pages = append(record.Pages, page)
-		start := page * this.pageSize
-		end := start + this.pageSize
-		ct := copy(this.mmap[start:end], data)
-		//Logger("stored %d in page %d (%q)", end-start, page, string(this.mmap[start:end]))
-		data = data[ct:]
 	}
+	this.reclaim()
+	this.autoCheckpoint()
+	this.autoCompact()
+}
 
-	_, err := this.log.WriteString(record.formatLog() + "\n")
+func (this *DB) writeLog(r record) error {
+	f := frame(r.encode())
+	_, err := this.log.Write(f)
 	if err != nil {
 		return fmt.Errorf("can't write log: %w", err)
 	}
-
-	old := this.trie.Put(key, record.val())
-	if old != nil {
-		// put the old pages in the free list
-		//Logger("now unused: %v", (*old)[1:])
-		this.unused = append(this.unused, (*old)[1:]...)
-	}
+	this.logged(f, len(r.entries()))
 	return nil
 }
 
+// keep track of where the log ends, after writing the given frame
+func (this *DB) logged(f []byte, records int) {
+	this.logOff += int64(len(f))
+	this.logRecords += records
+	copy(this.logLast[:], f)
+}
+
 func (this *DB) Sync() error {
+	this.m.Lock()
+	defer this.m.Unlock()
+	return this.sync()
+}
+
+// flush data.db and index.log, which can be replaced by grow and by compactions
+// must be called while holding the lock
+func (this *DB) sync() error {
 	err := unix.Msync(this.mmap, unix.MS_SYNC)
 	if err != nil {
 		return err
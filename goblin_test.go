@@ -1,12 +1,16 @@
 package goblin_test
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ohait/goblin"
+	"github.com/ohait/goblin/trie"
 )
 
 func noError(t *testing.T, err error) {
@@ -81,8 +85,9 @@ func TestDB(t *testing.T) {
 	goblin.Logger = t.Logf
 	t.Logf("reopened: %d", db.Size())
 	_ = db.Range(func(p goblin.Pair) error {
-		t.Logf("%q => %s", p.Key, p.Fetch())
-		return nil
+		x, err := p.Fetch()
+		t.Logf("%q => %s", p.Key, x)
+		return err
 	})
 	if db.Size() != 1 {
 		t.Fatalf("expected 1 entries, got %d", db.Size())
@@ -121,6 +126,550 @@ func TestGrow(t *testing.T) {
 	}
 }
 
+func TestDelete(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+
+	noError(t, db.Store("a", []byte("A")))
+	noError(t, db.Store("b", long(1000)))
+	noError(t, db.Store("c", []byte("C")))
+	noError(t, db.Delete("b"))
+	noError(t, db.Delete("missing"))
+	if db.Size() != 2 {
+		t.Fatalf("expected 2 entries, got %d", db.Size())
+	}
+	x, err := db.Fetch("b")
+	noError(t, err)
+	if x != nil {
+		t.Fatalf("expected no data, got %q", x)
+	}
+	t.Logf("after delete %v", db)
+	noError(t, db.Close())
+
+	// the tombstone must be replayed
+	db, err = goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	if db.Size() != 2 {
+		t.Fatalf("expected 2 entries, got %d", db.Size())
+	}
+	x, err = db.Fetch("b")
+	noError(t, err)
+	if x != nil {
+		t.Fatalf("expected no data, got %q", x)
+	}
+	// the freed pages are reused
+	t.Logf("reopened %v", db)
+	noError(t, db.Store("d", long(1000)))
+	x, err = db.Fetch("a")
+	noError(t, err)
+	if string(x) != "A" {
+		t.Fatalf("expected A, got %q", x)
+	}
+
+	// and dropped by optimize
+	noError(t, db.Optimize())
+	noError(t, db.Close())
+	log, err := os.ReadFile("/tmp/test-goblin/index.log")
+	noError(t, err)
+	if strings.Contains(string(log), "\x01b") { // key length and key
+		t.Fatalf("tombstone still in log: %q", log)
+	}
+	db, err = goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	defer db.Close()
+	if db.Size() != 3 {
+		t.Fatalf("expected 3 entries, got %d", db.Size())
+	}
+}
+
+func TestBatch(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+
+	noError(t, db.Store("doc", []byte("old")))
+	noError(t, db.Store("by-name/old", []byte("doc")))
+
+	var b goblin.Batch
+	b.Put("doc", long(600))
+	b.Delete("by-name/old")
+	b.Put("by-name/new", []byte("doc"))
+	b.Put("tmp", []byte("tmp"))
+	b.Delete("tmp")
+	noError(t, db.Write(&b))
+	noError(t, db.Close())
+
+	db, err = goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	defer db.Close()
+	keys := []string{}
+	_ = db.Range(func(p goblin.Pair) error {
+		keys = append(keys, p.Key)
+		return nil
+	})
+	if strings.Join(keys, ",") != "by-name/new,doc" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	x, err := db.Fetch("doc")
+	noError(t, err)
+	if string(x) != string(long(600)) {
+		t.Fatalf("expected long(600), got %q", x)
+	}
+}
+
+func TestStoreIf(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+
+	noError(t, db.StoreIf("a", []byte("A1"), 0))
+	var conflict goblin.ErrConflict
+	err = db.StoreIf("a", []byte("A2"), 0)
+	if !errors.As(err, &conflict) {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+	t.Logf("conflict: %v", err)
+
+	x, v1, err := db.FetchVersion("a")
+	noError(t, err)
+	if string(x) != "A1" || v1 == 0 {
+		t.Fatalf("unexpected %q v%d", x, v1)
+	}
+	noError(t, db.StoreIf("a", []byte("A2"), v1))
+	x, v2, err := db.FetchVersion("a")
+	noError(t, err)
+	if string(x) != "A2" || v2 <= v1 {
+		t.Fatalf("unexpected %q v%d", x, v2)
+	}
+	err = db.StoreIf("a", []byte("A3"), v1)
+	if !errors.As(err, &conflict) || conflict.Actual != v2 {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+
+	// the newest version is deleted, but must not be reused
+	noError(t, db.Store("b", []byte("B")))
+	_, v3, _ := db.FetchVersion("b")
+	noError(t, db.Delete("b"))
+	noError(t, db.Optimize())
+	noError(t, db.Close())
+
+	db, err = goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	defer db.Close()
+	_, v, err := db.FetchVersion("a")
+	noError(t, err)
+	if v != v2 {
+		t.Fatalf("expected version %d, got %d", v2, v)
+	}
+	noError(t, db.Store("b", []byte("B")))
+	_, v4, _ := db.FetchVersion("b")
+	if v4 <= v3 {
+		t.Fatalf("version went back from %d to %d", v3, v4)
+	}
+}
+
+func TestRangePrefix(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	defer db.Close()
+
+	for _, tenant := range []string{"t1", "t2", "t3"} {
+		for i := 0; i < 5; i++ {
+			k := fmt.Sprintf("%s/%03d", tenant, i)
+			noError(t, db.Store(k, []byte(k)))
+		}
+	}
+	var keys []string
+	err = db.RangePrefix("t2/", func(p goblin.Pair) error {
+		x, err := p.Fetch()
+		noError(t, err)
+		if string(x) != p.Key {
+			t.Fatalf("unexpected value %q for %q", x, p.Key)
+		}
+		keys = append(keys, p.Key)
+		return nil
+	})
+	noError(t, err)
+	if strings.Join(keys, ",") != "t2/000,t2/001,t2/002,t2/003,t2/004" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	keys = nil
+	err = db.RangePrefixReverse("t3/", func(p goblin.Pair) error {
+		keys = append(keys, p.Key)
+		if len(keys) == 2 {
+			return trie.EOD
+		}
+		return nil
+	})
+	noError(t, err)
+	if strings.Join(keys, ",") != "t3/004,t3/003" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	if ct := db.CountPrefix("t2/"); ct != 5 {
+		t.Fatalf("expected 5 keys, got %d", ct)
+	}
+	if ct := db.CountRange("t1/003", "t2/002"); ct != 4 {
+		t.Fatalf("expected 4 keys, got %d", ct)
+	}
+	if r := db.Rank("t2/000"); r != 5 {
+		t.Fatalf("expected rank 5, got %d", r)
+	}
+	if p, ok := db.Nth(7); !ok || p.Key != "t2/002" {
+		t.Fatalf("unexpected 7th key %q", p.Key)
+	}
+	if _, ok := db.Nth(15); ok {
+		t.Fatalf("expected no 15th key")
+	}
+
+	keys = nil
+	err = db.RangeBetween("t1/003", "t2/002", func(p goblin.Pair) error {
+		keys = append(keys, p.Key)
+		return nil
+	})
+	noError(t, err)
+	if strings.Join(keys, ",") != "t1/003,t1/004,t2/000,t2/001" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	opts := goblin.Options{
+		PageSize:    64,
+		InitialSize: 1024,
+		GrowStep:    1024,
+		MaxSize:     4096,
+		FileMode:    0600,
+		LockTimeout: -1,
+		Logger:      t.Logf,
+	}
+	db, err := goblin.Open("/tmp/test-goblin/", opts)
+	noError(t, err)
+	t.Logf("init %v", db)
+
+	_, err = goblin.Open("/tmp/test-goblin/", opts)
+	if err != goblin.ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	// 64 pages of 64 bytes
+	for i := 0; i < 32; i++ {
+		noError(t, db.Store(fmt.Sprint(i), long(100)))
+	}
+	err = db.Store("full", long(100))
+	if !errors.Is(err, goblin.ErrFull) {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+	t.Logf("full %v", db)
+	noError(t, db.Close())
+
+	fs, err := os.Stat("/tmp/test-goblin/data.db")
+	noError(t, err)
+	if fs.Size() != 4096 || fs.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected data.db: %d bytes, %v", fs.Size(), fs.Mode())
+	}
+
+	_, err = goblin.Open("/tmp/test-goblin/", goblin.Options{PageSize: 4096})
+	if err == nil {
+		t.Fatalf("expected an error for a different page size")
+	}
+	t.Logf("page size mismatch: %v", err)
+
+	db, err = goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	defer db.Close()
+	x, err := db.Fetch("31")
+	noError(t, err)
+	if string(x) != string(long(100)) {
+		t.Fatalf("expected long(100), got %q", x)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	noError(t, db.Store("a", []byte("A")))
+	noError(t, db.Close())
+
+	meta, err := os.ReadFile("/tmp/test-goblin/meta.json")
+	noError(t, err)
+	t.Logf("meta.json: %s", meta)
+	if !strings.Contains(string(meta), `"magic": "goblin"`) {
+		t.Fatalf("no magic in meta.json")
+	}
+
+	// created before meta.json: JSON lines, or even older space separated entries
+	_ = os.RemoveAll("/tmp/test-goblin-legacy")
+	noError(t, os.MkdirAll("/tmp/test-goblin-legacy", 0777))
+	data := make([]byte, 1<<20)
+	copy(data[0:], "A")
+	copy(data[256:], "BB")
+	noError(t, os.WriteFile("/tmp/test-goblin-legacy/data.db", data, 0666))
+	noError(t, os.WriteFile("/tmp/test-goblin-legacy/index.log", []byte("b 2 1\n"+
+		`{"key":"a","size":1,"pages":[0]}`+"\n"+
+		`{"key":"c","si`), 0666)) // torn
+	db, err = goblin.New("/tmp/test-goblin-legacy/")
+	noError(t, err)
+	if db.Size() != 2 {
+		t.Fatalf("expected 2 keys, got %d", db.Size())
+	}
+	x, err := db.Fetch("a")
+	noError(t, err)
+	if string(x) != "A" {
+		t.Fatalf("expected A, got %q", x)
+	}
+	x, err = db.Fetch("b")
+	noError(t, err)
+	if string(x) != "BB" {
+		t.Fatalf("expected BB, got %q", x)
+	}
+	noError(t, db.Close())
+	upgraded, err := os.ReadFile("/tmp/test-goblin-legacy/meta.json")
+	noError(t, err)
+	if !strings.Contains(string(upgraded), `"magic": "goblin"`) {
+		t.Fatalf("meta.json not upgraded: %s", upgraded)
+	}
+	db, err = goblin.New("/tmp/test-goblin-legacy/")
+	noError(t, err)
+	if db.Size() != 2 {
+		t.Fatalf("expected 2 keys, got %d", db.Size())
+	}
+	noError(t, db.Close())
+
+	// from the future
+	future := regexp.MustCompile(`"version": \d+`).ReplaceAllString(string(meta), `"version": 99`)
+	noError(t, os.WriteFile("/tmp/test-goblin/meta.json", []byte(future), 0666))
+	_, err = goblin.New("/tmp/test-goblin/")
+	if err == nil {
+		t.Fatalf("expected an error for a newer format")
+	}
+	t.Logf("newer format: %v", err)
+
+	// not ours
+	other := strings.Replace(string(meta), `"magic": "goblin"`, `"magic": "troll"`, 1)
+	noError(t, os.WriteFile("/tmp/test-goblin/meta.json", []byte(other), 0666))
+	_, err = goblin.New("/tmp/test-goblin/")
+	if err == nil {
+		t.Fatalf("expected an error for a foreign meta.json")
+	}
+	t.Logf("foreign meta: %v", err)
+
+	_ = os.RemoveAll("/tmp/test-goblin")
+	noError(t, os.MkdirAll("/tmp/test-goblin", 0777))
+	noError(t, os.WriteFile("/tmp/test-goblin/data.db", long(1024), 0666))
+	noError(t, os.WriteFile("/tmp/test-goblin/index.log", []byte("<html>\n"), 0666))
+	_, err = goblin.New("/tmp/test-goblin/")
+	if err == nil {
+		t.Fatalf("expected an error for foreign files")
+	}
+	t.Logf("foreign files: %v", err)
+
+	// a data file alone is not adopted either
+	noError(t, os.Remove("/tmp/test-goblin/index.log"))
+	_, err = goblin.New("/tmp/test-goblin/")
+	if err == nil {
+		t.Fatalf("expected an error without index.log")
+	}
+	t.Logf("no index.log: %v", err)
+
+	// but a DB which was never written has an empty log, and the first key may be empty
+	for _, log := range []string{"", " 2 1\n", `{"key":"","size":2,"pages":[1]}` + "\n"} {
+		_ = os.RemoveAll("/tmp/test-goblin-legacy")
+		noError(t, os.MkdirAll("/tmp/test-goblin-legacy", 0777))
+		noError(t, os.WriteFile("/tmp/test-goblin-legacy/data.db", data, 0666))
+		noError(t, os.WriteFile("/tmp/test-goblin-legacy/index.log", []byte(log), 0666))
+		db, err = goblin.New("/tmp/test-goblin-legacy/")
+		noError(t, err)
+		if expect := strings.Count(log, "\n"); db.Size() != expect {
+			t.Fatalf("expected %d keys, got %d", expect, db.Size())
+		}
+		noError(t, db.Close())
+	}
+
+}
+
+func TestCorrupt(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	defer db.Close()
+
+	noError(t, db.Store("a", long(300))) // pages 0 and 1
+	noError(t, db.Store("b", []byte("B")))
+	noError(t, db.Store("c", long(100))) // in a slot of page 2
+
+	// flip a byte in the second page and in c, the file is mmap-ed so the DB sees it
+	f, err := os.OpenFile("/tmp/test-goblin/data.db", os.O_RDWR, 0)
+	noError(t, err)
+	_, err = f.WriteAt([]byte("X"), 256+10)
+	noError(t, err)
+	_, err = f.WriteAt([]byte("X"), 512+10)
+	noError(t, err)
+	noError(t, f.Close())
+
+	var corrupt goblin.ErrCorrupt
+	_, err = db.Fetch("a")
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	if corrupt.Key != "a" || fmt.Sprint(corrupt.Extents) != "[0-1]" || corrupt.Offset != 0 {
+		t.Fatalf("unexpected error %+v", corrupt)
+	}
+	t.Logf("fetch: %v", err)
+
+	_, err = db.Fetch("c")
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	if corrupt.Key != "c" || fmt.Sprint(corrupt.Extents) != "[2]" || corrupt.Offset != 512 {
+		t.Fatalf("unexpected error %+v", corrupt)
+	}
+
+	err = db.Range(func(p goblin.Pair) error {
+		_, err := p.Fetch()
+		return err
+	})
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+
+	x, err := db.Fetch("b")
+	noError(t, err)
+	if string(x) != "B" {
+		t.Fatalf("expected B, got %q", x)
+	}
+}
+
+func TestTornLog(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	noError(t, db.Store("a", []byte("A")))
+	noError(t, db.Store("b", []byte("B")))
+	noError(t, db.Store("c", []byte("C")))
+	noError(t, db.Close())
+
+	log, err := os.ReadFile("/tmp/test-goblin/index.log")
+	noError(t, err)
+
+	// crash while writing the 4th entry
+	torn := append(append([]byte{}, log...), log[:len(log)/3]...)
+	noError(t, os.WriteFile("/tmp/test-goblin/index.log", torn, 0666))
+	db, err = goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	if db.Size() != 3 {
+		t.Fatalf("expected 3 keys, got %d", db.Size())
+	}
+	noError(t, db.Store("d", []byte("D")))
+	noError(t, db.Close())
+	db, err = goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	if db.Size() != 4 {
+		t.Fatalf("expected 4 keys, got %d", db.Size())
+	}
+	noError(t, db.Close())
+
+	// corruption in the middle is not recoverable, when the whole log is replayed
+	noError(t, os.Remove("/tmp/test-goblin/index.ckpt"))
+	log, err = os.ReadFile("/tmp/test-goblin/index.log")
+	noError(t, err)
+	good := append([]byte{}, log...)
+
+	// a length which would go past the end is not a torn entry
+	log[1] = 0xff
+	noError(t, os.WriteFile("/tmp/test-goblin/index.log", log, 0666))
+	_, err = goblin.New("/tmp/test-goblin/")
+	if err == nil || !strings.Contains(err.Error(), "offset 0") {
+		t.Fatalf("expected an error at offset 0, got %v", err)
+	}
+	t.Logf("corrupted length: %v", err)
+	fs, err := os.Stat("/tmp/test-goblin/index.log")
+	noError(t, err)
+	if fs.Size() != int64(len(good)) {
+		t.Fatalf("expected index.log to be left alone, got %d bytes", fs.Size())
+	}
+
+	log = good
+	log[len(log)/2] ^= 0xff
+	noError(t, os.WriteFile("/tmp/test-goblin/index.log", log, 0666))
+	_, err = goblin.New("/tmp/test-goblin/")
+	if err == nil || !strings.Contains(err.Error(), "offset") {
+		t.Fatalf("expected an error with the offset, got %v", err)
+	}
+	t.Logf("corrupted: %v", err)
+}
+
+func TestCheckpoint(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	for i := 0; i < 1000; i++ {
+		noError(t, db.Store(fmt.Sprintf("key-%04d", i), []byte(fmt.Sprint(i))))
+	}
+	noError(t, db.Delete("key-0500"))
+	noError(t, db.Checkpoint())
+
+	// after the checkpoint
+	noError(t, db.Store("key-0001", long(1000)))
+	noError(t, db.Delete("key-0002"))
+	noError(t, db.Close())
+
+	check := func(what string) {
+		t.Helper()
+		db, err := goblin.New("/tmp/test-goblin/")
+		noError(t, err)
+		defer db.Close()
+		if db.Size() != 998 {
+			t.Fatalf("%s: expected 998 keys, got %d", what, db.Size())
+		}
+		x, err := db.Fetch("key-0001")
+		noError(t, err)
+		if string(x) != string(long(1000)) {
+			t.Fatalf("%s: expected long(1000), got %q", what, x)
+		}
+		x, err = db.Fetch("key-0999")
+		noError(t, err)
+		if string(x) != "999" {
+			t.Fatalf("%s: expected 999, got %q", what, x)
+		}
+		// the free pages must be right, or this would overwrite some other value
+		noError(t, db.Store("new", long(2000)))
+		x, err = db.Fetch("key-0998")
+		noError(t, err)
+		if string(x) != "998" {
+			t.Fatalf("%s: expected 998, got %q", what, x)
+		}
+		noError(t, db.Delete("new"))
+	}
+	check("checkpoint")
+
+	ckpt, err := os.ReadFile("/tmp/test-goblin/index.ckpt")
+	noError(t, err)
+	log, err := os.ReadFile("/tmp/test-goblin/index.log")
+	noError(t, err)
+	t.Logf("checkpoint %d bytes, log %d bytes", len(ckpt), len(log))
+
+	// a broken checkpoint is ignored
+	ckpt[len(ckpt)/2] ^= 0xff
+	noError(t, os.WriteFile("/tmp/test-goblin/index.ckpt", ckpt, 0666))
+	check("bad checkpoint")
+
+	// and so is one for another log
+	ckpt, err = os.ReadFile("/tmp/test-goblin/index.ckpt")
+	noError(t, err)
+	db, err = goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	noError(t, db.Optimize())
+	noError(t, db.Close())
+	noError(t, os.WriteFile("/tmp/test-goblin/index.ckpt", ckpt, 0666))
+	check("stale checkpoint")
+}
+
 func TestScale(t *testing.T) {
 	if testing.Short() {
 		t.SkipNow()
@@ -179,7 +728,7 @@ func TestScale(t *testing.T) {
 		tot := 0
 		t0 := time.Now()
 		_ = db.Range(func(p goblin.Pair) error {
-			data := p.Fetch()
+			data, _ := p.Fetch()
 			tot += len(data)
 			ct++
 			return nil
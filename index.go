@@ -1,153 +1,453 @@
 package goblin
 
 import (
-	"bufio"
-	"encoding/json"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math/bits"
 	"os"
-	"strconv"
-	"strings"
-	"time"
+
+	"github.com/ohait/goblin/trie"
 )
 
-// rebuild the log and drop old entries
-// will aquire a global lock until done
-func (this *DB) Optimize() error {
+// on start, we load the checkpoint and replay the log after it, to reconstruct the unused pages and the trie
+// a torn entry at the end of the log is dropped, but any other corruption is an error
+func (this *DB) rewind() error {
 	this.m.Lock()
 	defer this.m.Unlock()
-	return this.optimize()
-}
 
-func (this *DB) optimize() error {
-	Logger("Optimize")
+	fs, _ := this.data.Stat()
+
+	lenPages := (fs.Size() + int64(this.pageSize) - 1) / int64(this.pageSize)
 
-	newlog, err := os.OpenFile(this.logname+"~", os.O_RDWR|os.O_CREATE, 0666)
-	if err != nil {
-		return err
+	// we need a map of the used blocks, to build the free-blocks-list
+	used := make([]uint64, (lenPages+63)/64)
+
+	full := true
+	c, err := this.loadCheckpoint(lenPages, used)
+	if err == nil {
+		err = this.replay(c, used, lenPages)
+		full = err == errStale
 	}
-	t := time.Now().Add(time.Second)
-	err = this.trie.Range(func(k string, r []int) error {
-		now := time.Now()
-		if now.After(t) {
-			t = now.Add(time.Second)
-			Logger("Optimize %q...", k)
+	if full {
+		if !errors.Is(err, os.ErrNotExist) {
+			this.logger("ignoring the checkpoint: %v", err)
 		}
-		_, err := newlog.WriteString(record{k, r[0], r[1:]}.formatLog() + "\n")
-		return err
-	})
+		// start over, from the beginning of the log
+		this.trie = trie.Trie[value]{}
+		this.classes, this.slotSpace, this.slotBytes = nil, 0, 0
+		used = make([]uint64, (lenPages+63)/64)
+		c = checkpoint{}
+		err = this.replay(c, used, lenPages)
+	}
 	if err != nil {
 		return err
 	}
-	err = newlog.Sync()
+	this.ckptOff = c.off
+	this.slabsLoaded()
+
+	for page := 0; page < this.next; page++ {
+		u := used[page/64] & (1 << (page % 64))
+		//log.Printf("page %d use %v (%b)", page, u != 0, used[page/64])
+		if u == 0 {
+			this.unused.put(extents{{page, 1}})
+		}
+	}
+
+	this.autoCompact()
+
+	this.logger("rewind done, %d free pages, next new page at %d", this.unused.len(), this.next)
+	return nil
+}
+
+// replay the log from the checkpoint
+func (this *DB) replay(c checkpoint, used []uint64, lenPages int64) error {
+	this.seq, this.next = c.seq, c.next
+	this.logOff, this.logRecords, this.logLast = c.off, c.records, c.last
+
+	r, err := newLogReader(this.log, c.off)
 	if err != nil {
 		return err
 	}
-	err = os.Rename(this.logname+"~", this.logname)
+	// Defrag() can shrink data.db, so old records may refer to pages which are gone
+	// that's fine, as long as no live key uses them
+	beyond := map[string]int{}
+	for {
+		payload, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err == errTorn {
+			this.logger("dropping torn entry at the end of index.log, offset %d", r.off)
+			err = this.log.Truncate(r.off)
+			if err != nil {
+				return fmt.Errorf("can't truncate %q: %w", this.logname, err)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		entry, err := decode(payload)
+		if err != nil {
+			return fmt.Errorf("index.log is corrupted at offset %d: %w", r.off-int64(frameHeader+len(payload)), err)
+		}
+		if entry.Version == 0 {
+			// written before versions were introduced
+			entry.Version = this.seq + 1
+		}
+		if c.off > 0 && entry.Version <= c.seq {
+			return errStale // the checkpoint is newer than this
+		}
+		if entry.Version > this.seq {
+			this.seq = entry.Version
+		}
+		records := entry.entries()
+		this.logged(frame(payload), len(records))
+		for _, record := range records {
+			//log.Printf("rewind %q in %v: %q", id, record, r.Text())
+			delete(beyond, record.Key)
+			if end := record.val().span(this.pageSize).end(); int64(end) > lenPages {
+				beyond[record.Key] = end - 1
+			}
+			var old *value
+			if record.Deleted {
+				old = this.trie.Remove(record.Key)
+			} else {
+				old = this.trie.Put(record.Key, record.val())
+			}
+			if old != nil && (old.Class == 0 || this.unmarkSlot(*old)) {
+				for _, e := range old.span(this.pageSize) {
+					for page := e.Start; page < e.end() && int64(page) < lenPages; page++ {
+						used[page/64] &= ^(uint64(1) << (page % 64))
+					}
+				}
+			}
+			if record.Class > 0 {
+				this.markSlot(record.val())
+			}
+			for _, e := range record.val().span(this.pageSize) {
+				for page := e.Start; page < e.end() && int64(page) < lenPages; page++ {
+					used[page/64] |= (1 << (uint64(page) % 64))
+					if page >= this.next {
+						this.next = page + 1
+					}
+				}
+			}
+		}
+	}
+
+	for key, page := range beyond {
+		return fmt.Errorf("index.log refers to page %d for %q, but data.db has %d pages", page, key, lenPages)
+	}
+
+	// new entries go after the last good one
+	_, err = this.log.Seek(r.off, io.SeekStart)
 	if err != nil {
-		return err
+		return fmt.Errorf("can't seek: %w", err)
 	}
-	this.log = newlog
 	return nil
 }
 
-// on start, we replay the log to reconstruct the unused pages and the trie
-func (this *DB) rewind() error {
-	this.m.Lock()
-	defer this.m.Unlock()
+type record struct {
+	Key     string   `json:"key,omitempty"`
+	Size    int      `json:"size,omitempty"`
+	Extents extents  `json:"extents,omitempty"`
+	Pages   []int    `json:"pages,omitempty"`  // instead of extents, in older logs
+	Class   int      `json:"class,omitempty"`  // the size of the slot, for small values
+	Slot    int      `json:"slot,omitempty"`   // the offset in data.db is Slot*Class
+	Inline  []byte   `json:"inline,omitempty"` // the value itself, if it's small enough
+	Version uint64   `json:"version,omitempty"`
+	CRC     *uint32  `json:"crc,omitempty"`     // CRC32C of the value, missing in older records
+	Deleted bool     `json:"deleted,omitempty"` // tombstone
+	Batch   []record `json:"batch,omitempty"`   // a group of records to be applied atomically
 
-	_, err := this.log.Seek(0, io.SeekStart)
-	if err != nil {
-		return fmt.Errorf("can't seek: %w", err)
+	data []byte // the value, while it's being stored
+}
+
+// what the trie keeps for each key
+type value struct {
+	Version uint64
+	Size    int
+	Extents extents
+	Class   int
+	Slot    int
+	Inline  []byte
+	CRC     uint32
+	HasCRC  bool
+}
+
+func (this record) val() value {
+	v := value{Version: this.Version, Size: this.Size, Extents: this.Extents, Class: this.Class, Slot: this.Slot, Inline: this.Inline}
+	if this.CRC != nil {
+		v.CRC, v.HasCRC = *this.CRC, true
 	}
+	return v
+}
 
-	fs, _ := this.data.Stat()
+// the record to log for key
+func (this value) record(key string) record {
+	r := record{Key: key, Version: this.Version, Size: this.Size, Extents: this.Extents, Class: this.Class, Slot: this.Slot, Inline: this.Inline}
+	if this.HasCRC {
+		crc := this.CRC
+		r.CRC = &crc
+	}
+	return r
+}
 
-	lenPages := (fs.Size() + int64(this.pageSize) - 1) / int64(this.pageSize)
+func (this value) pair(key string, db *DB) Pair {
+	return Pair{Key: key, Version: this.Version, sto: db, val: this}
+}
 
-	// we need a map of the used blocks, to build the free-blocks-list
-	used := make([]uint64, (lenPages+63)/64)
+// move the pages of older records to extents, in the batch too
+func (this *record) upgrade() {
+	if this.Pages != nil {
+		this.Extents = toExtents(this.Pages)
+		this.Pages = nil
+	}
+	for i := range this.Batch {
+		this.Batch[i].upgrade()
+	}
+}
 
-	r := bufio.NewScanner(this.log)
-	ct := 0
-	for r.Scan() {
-		record := parseLog(r.Text())
-		ct++
-		//log.Printf("rewind %q in %v: %q", id, record, r.Text())
-		old := this.trie.Put(record.Key, record.val())
-		if old != nil {
-			for _, page := range *old {
-				used[page/64] &= ^(uint64(1) << (page % 64))
-			}
-		}
-		for _, page := range record.Pages {
-			used[page/64] |= (1 << (uint64(page) % 64))
-			if page >= this.next {
-				this.next = page + 1
-			}
+// the records to apply for this log entry
+// records in a batch share the version of the batch, unless they have their own
+func (this record) entries() []record {
+	if this.Batch == nil {
+		return []record{this}
+	}
+	for i := range this.Batch {
+		if this.Batch[i].Version == 0 {
+			this.Batch[i].Version = this.Version
 		}
 	}
+	return this.Batch
+}
 
-	for page := 0; page < this.next; page++ {
-		u := used[page/64] & (1 << (page % 64))
-		//log.Printf("page %d use %v (%b)", page, u != 0, used[page/64])
-		if u == 0 {
-			this.unused = append(this.unused, page)
+// the binary encoding of a log entry:
+//
+//	flags (byte): batch
+//	version (uvarint)
+//	if batch: the number of records (uvarint), then each record
+//	otherwise: one record
+//
+// and each record is:
+//
+//	flags (byte): deleted, has crc, has version, in a slot, inline
+//	key: length (uvarint) and bytes
+//	version (uvarint) if present, only in batches
+//	unless deleted:
+//	  size (uvarint)
+//	  crc (uint32, little endian) if present
+//	  if inline:
+//	    the value (size bytes)
+//	  if in a slot:
+//	    the size of the slot as a power of 2 (byte), and the slot (uvarint)
+//	  otherwise:
+//	    number of extents (uvarint)
+//	    each extent as the distance of its start from the end of the previous one (varint), and its length (uvarint)
+const (
+	flagBatch   = 1
+	flagDeleted = 1
+	flagCRC     = 2
+	flagVersion = 4
+	flagSlot    = 8
+	flagInline  = 16
+)
+
+func (this record) encode() []byte {
+	out := make([]byte, 0, 32)
+	if this.Batch != nil {
+		out = append(out, flagBatch)
+		out = binary.AppendUvarint(out, this.Version)
+		out = binary.AppendUvarint(out, uint64(len(this.Batch)))
+		for _, r := range this.Batch {
+			out = r.appendTo(out, true)
 		}
+		return out
 	}
+	out = append(out, 0)
+	out = binary.AppendUvarint(out, this.Version)
+	return this.appendTo(out, false)
+}
 
-	if ct > this.trie.Count()*3/2+10 {
-		err = this.optimize()
-		if err != nil {
-			return fmt.Errorf("can't rebuild log file: %w", err)
+// withVersion writes the version of the record, if it has one
+func (this record) appendTo(out []byte, withVersion bool) []byte {
+	var flags byte
+	if this.Deleted {
+		flags |= flagDeleted
+	}
+	if this.CRC != nil {
+		flags |= flagCRC
+	}
+	if withVersion && this.Version != 0 {
+		flags |= flagVersion
+	}
+	if this.Class > 0 {
+		flags |= flagSlot
+	}
+	if this.Inline != nil {
+		flags |= flagInline
+	}
+	out = append(out, flags)
+	out = binary.AppendUvarint(out, uint64(len(this.Key)))
+	out = append(out, this.Key...)
+	if flags&flagVersion != 0 {
+		out = binary.AppendUvarint(out, this.Version)
+	}
+	if this.Deleted {
+		return out
+	}
+	out = binary.AppendUvarint(out, uint64(this.Size))
+	if this.CRC != nil {
+		out = binary.LittleEndian.AppendUint32(out, *this.CRC)
+	}
+	if this.Inline != nil {
+		return append(out, this.Inline...)
+	}
+	if this.Class > 0 {
+		out = append(out, byte(bits.TrailingZeros(uint(this.Class))))
+		return binary.AppendUvarint(out, uint64(this.Slot))
+	}
+	out = binary.AppendUvarint(out, uint64(len(this.Extents)))
+	prev := 0
+	for _, e := range this.Extents {
+		out = binary.AppendVarint(out, int64(e.Start-prev))
+		out = binary.AppendUvarint(out, uint64(e.Len))
+		prev = e.end()
+	}
+	return out
+}
+
+func decode(payload []byte) (r record, err error) {
+	d := decoder{buf: payload}
+	flags := d.byte()
+	r.Version = d.uvarint()
+	if flags&flagBatch != 0 {
+		ct := d.uvarint()
+		if ct > uint64(len(payload)) {
+			return r, fmt.Errorf("invalid batch of %d records", ct)
+		}
+		r.Batch = make([]record, 0, ct)
+		for i := uint64(0); i < ct && d.err == nil; i++ {
+			r.Batch = append(r.Batch, d.record())
 		}
+	} else {
+		v := r.Version
+		r = d.record()
+		r.Version = v
 	}
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = fmt.Errorf("%d extra bytes", len(d.buf))
+	}
+	return r, d.err
+}
 
-	Logger("rewind done, %d free pages, next new page at %d", len(this.unused), this.next)
-	return nil
+// read the binary encoding, after an error all the reads return zero values
+type decoder struct {
+	buf []byte
+	err error
 }
 
-type record struct {
-	Key   string `json:"key"`
-	Size  int    `json:"size"`
-	Pages []int  `json:"pages"`
+func (this *decoder) fail(what string) {
+	if this.err == nil {
+		this.err = fmt.Errorf("can't decode %s", what)
+	}
+	this.buf = nil
 }
 
-func (this record) val() []int {
-	return append([]int{this.Size}, this.Pages...)
+func (this *decoder) byte() byte {
+	if len(this.buf) == 0 {
+		this.fail("flags")
+		return 0
+	}
+	b := this.buf[0]
+	this.buf = this.buf[1:]
+	return b
 }
 
-func parseLog(ln string) (r record) {
-	err := json.Unmarshal([]byte(ln), &r)
-	if err != nil {
-		return parseLog_(ln) // backward compat (only temporary)
-		//panic(err)
+func (this *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(this.buf)
+	if n <= 0 {
+		this.fail("uvarint")
+		return 0
 	}
-	return
+	this.buf = this.buf[n:]
+	return v
 }
 
-func (this record) formatLog() string {
-	j, err := json.Marshal(this)
-	if err != nil {
-		panic(err)
+func (this *decoder) varint() int64 {
+	v, n := binary.Varint(this.buf)
+	if n <= 0 {
+		this.fail("varint")
+		return 0
 	}
-	return string(j)
+	this.buf = this.buf[n:]
+	return v
 }
 
-func parseLog_(ln string) record {
-	parts := strings.Split(ln, " ")
-	name, parts := parts[0], parts[1:]
-	i := []int{}
-	for _, part := range parts {
-		id, err := strconv.Atoi(part)
-		if err != nil {
-			panic(err)
+func (this *decoder) bytes(l uint64) []byte {
+	if uint64(len(this.buf)) < l {
+		this.fail("bytes")
+		return nil
+	}
+	b := this.buf[:l]
+	this.buf = this.buf[l:]
+	return b
+}
+
+func (this *decoder) record() (r record) {
+	flags := this.byte()
+	r.Key = string(this.bytes(this.uvarint()))
+	if flags&flagVersion != 0 {
+		r.Version = this.uvarint()
+	}
+	if flags&flagDeleted != 0 {
+		r.Deleted = true
+		return r
+	}
+	r.Size = int(this.uvarint())
+	if flags&flagCRC != 0 {
+		if b := this.bytes(4); b != nil {
+			crc := binary.LittleEndian.Uint32(b)
+			r.CRC = &crc
 		}
-		i = append(i, id)
 	}
-	return record{
-		Key:   name,
-		Size:  i[0],
-		Pages: i[1:],
+	if flags&flagInline != 0 {
+		if b := this.bytes(uint64(r.Size)); b != nil {
+			r.Inline = append(make([]byte, 0, len(b)), b...) // the buffer is reused
+		}
+		return r
+	}
+	if flags&flagSlot != 0 {
+		shift := this.byte()
+		if shift >= 31 {
+			this.fail("slot")
+			return r
+		}
+		r.Class = 1 << shift
+		r.Slot = int(this.uvarint())
+		return r
+	}
+	ct := this.uvarint()
+	if ct > uint64(len(this.buf)) {
+		this.fail("extents")
+		return r
+	}
+	if ct > 0 {
+		r.Extents = make(extents, 0, ct)
+	}
+	prev := 0
+	for i := uint64(0); i < ct && this.err == nil; i++ {
+		e := Extent{Start: prev + int(this.varint())}
+		e.Len = int(this.uvarint())
+		if e.Start < 0 || e.Len <= 0 {
+			this.fail("extent")
+			break
+		}
+		r.Extents = append(r.Extents, e)
+		prev = e.end()
 	}
+	return r
 }
@@ -0,0 +1,99 @@
+package goblin_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ohait/goblin"
+)
+
+func TestInline(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+
+	for i := 0; i < 100; i++ {
+		noError(t, db.Store(fmt.Sprintf("flag-%03d", i), []byte(fmt.Sprint(i))))
+	}
+	noError(t, db.Store("big", long(1000)))
+	noError(t, db.Store("big", []byte("small"))) // the pages are freed
+	noError(t, db.Store("flag-000", long(1000))) // and used again
+
+	s := db.Stats()
+	t.Logf("stats: %+v", s)
+	if s.Inline != 100 || s.Free != s.Pages-4 {
+		t.Fatalf("expected 100 inline values in no pages, got %+v", s)
+	}
+
+	x, err := db.Fetch("flag-042")
+	noError(t, err)
+	if string(x) != "42" {
+		t.Fatalf("expected 42, got %q", x)
+	}
+	x[0] = 'X' // it's a copy
+	err = db.RangePrefix("flag-04", func(p goblin.Pair) error {
+		x, err := p.Fetch()
+		noError(t, err)
+		if p.Key == "flag-042" && string(x) != "42" {
+			t.Fatalf("expected 42, got %q", x)
+		}
+		return nil
+	})
+	noError(t, err)
+
+	check := func(db *goblin.DB) {
+		t.Helper()
+		for i := 1; i < 100; i++ {
+			x, err := db.Fetch(fmt.Sprintf("flag-%03d", i))
+			noError(t, err)
+			if string(x) != fmt.Sprint(i) {
+				t.Fatalf("expected %d, got %q", i, x)
+			}
+		}
+		x, err := db.Fetch("big")
+		noError(t, err)
+		if string(x) != "small" {
+			t.Fatalf("expected small, got %q", x)
+		}
+		x, err = db.Fetch("flag-000")
+		noError(t, err)
+		if string(x) != string(long(1000)) {
+			t.Fatalf("expected long(1000), got %d bytes", len(x))
+		}
+	}
+	check(db)
+	noError(t, db.Optimize())
+	check(db)
+	noError(t, db.Close())
+
+	// from the checkpoint, and from the log
+	for _, ckpt := range []bool{true, false} {
+		if !ckpt {
+			noError(t, os.Remove("/tmp/test-goblin/index.ckpt"))
+		}
+		db, err = goblin.New("/tmp/test-goblin/")
+		noError(t, err)
+		check(db)
+		if s := db.Stats(); s.Inline != 100 || s.Free != s.Pages-4 {
+			t.Fatalf("expected 100 inline values in no pages, got %+v", s)
+		}
+		noError(t, db.Close())
+	}
+
+	report, err := goblin.Verify("/tmp/test-goblin/")
+	noError(t, err)
+	if !report.OK() || report.Used != 4 {
+		t.Fatalf("verify: %v", report)
+	}
+
+	// can be disabled
+	db, err = goblin.Open("/tmp/test-goblin/", goblin.Options{InlineSize: -1})
+	noError(t, err)
+	defer db.Close()
+	noError(t, db.Store("flag-100", []byte("100")))
+	if s := db.Stats(); s.Inline != 100 || len(s.Classes) != 1 || s.Classes[0].Used != 1 {
+		t.Fatalf("expected a new value in a slot, got %+v", s)
+	}
+	check(db)
+}
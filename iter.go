@@ -0,0 +1,55 @@
+//go:build go1.23
+
+package goblin
+
+import (
+	"iter"
+
+	"github.com/ohait/goblin/trie"
+)
+
+// iterate over all the keys in lexicographic order
+func (this *DB) All() iter.Seq2[string, Pair] {
+	return func(yield func(string, Pair) bool) {
+		_ = this.Range(func(p Pair) error {
+			if !yield(p.Key, p) {
+				return trie.EOD
+			}
+			return nil
+		})
+	}
+}
+
+// iterate over all the keys in reverse lexicographic order
+func (this *DB) Backward() iter.Seq2[string, Pair] {
+	return func(yield func(string, Pair) bool) {
+		_ = this.RangeReverse(func(p Pair) error {
+			if !yield(p.Key, p) {
+				return trie.EOD
+			}
+			return nil
+		})
+	}
+}
+
+// iterate from the current position (included) to the end, moving the cursor
+func (this *Cursor) Forward() iter.Seq2[string, Pair] {
+	return func(yield func(string, Pair) bool) {
+		for p, ok := this.Current(); ok; p, ok = this.Next() {
+			if !yield(p.Key, p) {
+				return
+			}
+		}
+	}
+}
+
+// iterate from the current position (included) to the beginning, moving the cursor
+func (this *Cursor) Backward() iter.Seq2[string, Pair] {
+	return func(yield func(string, Pair) bool) {
+		for p, ok := this.Current(); ok; p, ok = this.Prev() {
+			if !yield(p.Key, p) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+//go:build go1.23
+
+package goblin_test
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ohait/goblin"
+)
+
+func TestCursor(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		k := fmt.Sprintf("k%02d", i)
+		noError(t, db.Store(k, []byte(k)))
+	}
+
+	// paginate by 3, resuming from the last key
+	c := db.Cursor()
+	var pages []string
+	token := ""
+	for {
+		var page []string
+		c.Seek(token)
+		for k, p := range c.Forward() {
+			if len(page) == 3 {
+				token = k
+				break
+			}
+			x, err := p.Fetch()
+			noError(t, err)
+			if string(x) != k {
+				t.Fatalf("unexpected value for %q: %q", k, x)
+			}
+			page = append(page, k)
+		}
+		pages = append(pages, strings.Join(page, ","))
+		if len(page) < 3 {
+			break
+		}
+	}
+	if strings.Join(pages, " ") != "k00,k01,k02 k03,k04,k05 k06,k07,k08 k09" {
+		t.Fatalf("unexpected pages: %v", pages)
+	}
+
+	var keys []string
+	for k := range db.Backward() {
+		keys = append(keys, k)
+		if len(keys) == 3 {
+			break
+		}
+	}
+	if strings.Join(keys, ",") != "k09,k08,k07" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	p, ok := c.Last()
+	if !ok || p.Key != "k09" {
+		t.Fatalf("unexpected last: %v", p.Key)
+	}
+	p, _ = c.Prev()
+	if p.Key != "k08" {
+		t.Fatalf("unexpected prev: %v", p.Key)
+	}
+	noError(t, db.Delete("k07"))
+	p, _ = c.Prev()
+	if p.Key != "k06" {
+		t.Fatalf("unexpected prev: %v", p.Key)
+	}
+	ct := 0
+	for range db.All() {
+		ct++
+	}
+	if ct != 9 {
+		t.Fatalf("expected 9 keys, got %d", ct)
+	}
+}
@@ -0,0 +1,92 @@
+package goblin
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// each entry in index.log is framed as:
+//
+//	length of the payload (uint32, little endian)
+//	CRC32C of the payload (uint32, little endian)
+//	CRC32C of the 8 bytes above (uint32, little endian)
+//	payload
+//
+// so a partially written entry can be detected and dropped, while a corrupted length is an error
+const frameHeader = 12
+
+func frame(payload []byte) []byte {
+	out := make([]byte, frameHeader, frameHeader+len(payload))
+	binary.LittleEndian.PutUint32(out[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(out[4:8], checksum(payload))
+	binary.LittleEndian.PutUint32(out[8:12], checksum(out[0:8]))
+	return append(out, payload...)
+}
+
+// the last entry in the log was not completely written
+var errTorn = errors.New("torn entry")
+
+// read the framed entries of a log file
+type logReader struct {
+	r    *bufio.Reader
+	off  int64 // where the next entry starts
+	size int64
+}
+
+// start from the given offset, which must be the beginning of an entry
+func newLogReader(f *os.File, off int64) (*logReader, error) {
+	fs, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Seek(off, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("can't seek: %w", err)
+	}
+	return &logReader{
+		r:    bufio.NewReaderSize(f, 1<<16),
+		off:  off,
+		size: fs.Size(),
+	}, nil
+}
+
+// return the next payload, io.EOF at the end of the log, or errTorn if the last entry is incomplete
+// the offset is not moved on errors, so it points to the start of the bad entry
+func (this *logReader) next() ([]byte, error) {
+	if this.off == this.size {
+		return nil, io.EOF
+	}
+	if this.size-this.off < frameHeader {
+		return nil, errTorn
+	}
+	header := make([]byte, frameHeader)
+	_, err := io.ReadFull(this.r, header)
+	if err != nil {
+		return nil, err
+	}
+	if checksum(header[0:8]) != binary.LittleEndian.Uint32(header[8:12]) {
+		return nil, fmt.Errorf("index.log is corrupted at offset %d: bad header", this.off)
+	}
+	l := int64(binary.LittleEndian.Uint32(header[0:4]))
+	end := this.off + frameHeader + l
+	if end > this.size {
+		return nil, errTorn
+	}
+	payload := make([]byte, l)
+	_, err = io.ReadFull(this.r, payload)
+	if err != nil {
+		return nil, err
+	}
+	if checksum(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+		if end == this.size {
+			return nil, errTorn // garbage at the end is just a torn write
+		}
+		return nil, fmt.Errorf("index.log is corrupted at offset %d: bad checksum", this.off)
+	}
+	this.off = end
+	return payload, nil
+}
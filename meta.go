@@ -0,0 +1,169 @@
+package goblin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const magic = "goblin"
+
+// the current format of the files, bump it when they change and add a migration in upgrade()
+const formatVersion = 1
+
+// the superblock, saved in meta.json next to the data
+type meta struct {
+	Magic    string    `json:"magic"`
+	Version  int       `json:"version"`
+	PageSize int       `json:"page_size"`
+	Created  time.Time `json:"created"`
+	Options  struct {
+		InitialSize int     `json:"initial_size"`
+		GrowFactor  float64 `json:"grow_factor"`
+		GrowStep    int     `json:"grow_step,omitempty"`
+		MaxSize     int     `json:"max_size,omitempty"`
+	} `json:"options"`
+}
+
+// read meta.json and check the files can be used, or create it for a new DB
+// fsize is the current size of data.db
+func (this *DB) loadMeta(fsize int64) error {
+	m, err := readMeta(this.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		if fsize == 0 {
+			return this.createMeta()
+		}
+		return this.legacyMeta(fsize)
+	}
+	if err != nil {
+		return err
+	}
+	if this.opts.PageSize != 0 && this.opts.PageSize != m.PageSize {
+		return fmt.Errorf("page size is %d, can't open with %d", m.PageSize, this.opts.PageSize)
+	}
+	if fsize%int64(m.PageSize) != 0 {
+		return fmt.Errorf("data.db is %d bytes, which is not a multiple of the page size %d", fsize, m.PageSize)
+	}
+	this.pageSize = m.PageSize
+	return this.upgrade(m)
+}
+
+// read and validate meta.json, return an error wrapping os.ErrNotExist if missing
+func readMeta(dir string) (m meta, err error) {
+	fname := filepath.Join(dir, "meta.json")
+	j, err := os.ReadFile(fname)
+	if err != nil {
+		return m, fmt.Errorf("can't read %q: %w", fname, err)
+	}
+	err = json.Unmarshal(j, &m)
+	if err != nil {
+		return m, fmt.Errorf("%q is not a goblin meta file: %w", fname, err)
+	}
+	switch {
+	case m.Magic != magic:
+		return m, fmt.Errorf("%q is not a goblin meta file: magic %q", fname, m.Magic)
+	case m.Version > formatVersion:
+		return m, fmt.Errorf("%q has format version %d, only %d is supported", dir, m.Version, formatVersion)
+	}
+	if m.PageSize < 16 || m.PageSize&(m.PageSize-1) != 0 {
+		return m, fmt.Errorf("%q has an invalid page size %d", fname, m.PageSize)
+	}
+	return m, nil
+}
+
+func (this *DB) createMeta() error {
+	m := meta{
+		Magic:    magic,
+		Version:  formatVersion,
+		PageSize: this.opts.PageSize,
+		Created:  time.Now().UTC(),
+	}
+	if m.PageSize == 0 {
+		m.PageSize = 256
+	}
+	m.Options.InitialSize = this.opts.InitialSize
+	m.Options.GrowFactor = this.opts.GrowFactor
+	m.Options.GrowStep = this.opts.GrowStep
+	m.Options.MaxSize = this.opts.MaxSize
+	this.pageSize = m.PageSize
+	return this.writeMeta(m)
+}
+
+// the DB was created before meta.json existed, which means 256 bytes pages and JSON (or older) logs
+// we check the log exists, and that it's empty (a DB never written) or starts with one of our entries, before adopting
+// the files
+func (this *DB) legacyMeta(fsize int64) error {
+	if this.opts.PageSize != 0 && this.opts.PageSize != 256 {
+		return fmt.Errorf("page size is 256, can't open with %d", this.opts.PageSize)
+	}
+	if fsize%256 != 0 {
+		return fmt.Errorf("data.db is %d bytes, which is not a multiple of the page size 256", fsize)
+	}
+	f, err := os.Open(this.logname)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%q is not a goblin DB: data.db but no index.log", this.dir)
+	}
+	if err != nil {
+		return fmt.Errorf("can't open %q: %w", this.logname, err)
+	}
+	defer f.Close()
+	ln, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("can't read %q: %w", this.logname, err)
+	}
+	if ln != "" {
+		_, err = parseLine(strings.TrimSuffix(ln, "\n"))
+		if err != nil {
+			return fmt.Errorf("%q is not a goblin DB: %w", this.dir, err)
+		}
+	}
+	this.logger("no meta.json in %q, using 256 bytes pages", this.dir)
+	this.pageSize = 256
+	return this.upgrade(meta{PageSize: 256})
+}
+
+// migrate the files from older formats, and save the new meta
+func (this *DB) upgrade(m meta) error {
+	if m.Magic == magic && m.Version == formatVersion {
+		return nil
+	}
+	this.logger("upgrading %q from format %d to %d", this.dir, m.Version, formatVersion)
+	// the log is converted straight to the current format
+	var err error
+	switch m.Version {
+	case 0:
+		// created before meta.json: one JSON record per line, or even older space separated entries
+		err = this.convertLog(this.scanLines)
+	}
+	if err != nil {
+		return fmt.Errorf("can't upgrade %q: %w", this.logname, err)
+	}
+	m.Version = formatVersion
+	m.Magic = magic
+	if m.Created.IsZero() {
+		m.Created = time.Now().UTC()
+	}
+	return this.writeMeta(m)
+}
+
+func (this *DB) writeMeta(m meta) error {
+	fname := filepath.Join(this.dir, "meta.json")
+	j, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(fname+"~", j, this.opts.FileMode)
+	if err == nil {
+		err = os.Rename(fname+"~", fname)
+	}
+	if err != nil {
+		return fmt.Errorf("can't write %q: %w", fname, err)
+	}
+	return nil
+}
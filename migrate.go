@@ -0,0 +1,102 @@
+package goblin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// rewrite index.log in the current format, reading the old entries with scan
+func (this *DB) convertLog(scan func(f *os.File, cb func(record) error) error) error {
+	f, err := os.Open(this.logname)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	out, err := os.OpenFile(this.logname+"~", os.O_RDWR|os.O_CREATE|os.O_TRUNC, this.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+
+	ct := 0
+	err = scan(f, func(r record) error {
+		ct++
+		_, err := w.Write(frame(r.encode()))
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil {
+		err = os.Rename(this.logname+"~", this.logname)
+	}
+	if err == nil {
+		this.logger("converted %d entries in %q", ct, this.logname)
+	}
+	return err
+}
+
+// format 0: one JSON record per line, or space separated key, size and pages
+func (this *DB) scanLines(f *os.File, cb func(record) error) error {
+	r := bufio.NewReader(f)
+	for lineno := 1; ; lineno++ {
+		ln, err := r.ReadString('\n')
+		if err == io.EOF {
+			if ln != "" {
+				// no newline, it was never completely written
+				this.logger("dropping the incomplete last line of %q: %q", this.logname, ln)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rec, err := parseLine(strings.TrimSuffix(ln, "\n"))
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineno, err)
+		}
+		rec.upgrade()
+		err = cb(rec)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func parseLine(ln string) (r record, err error) {
+	if strings.HasPrefix(ln, "{") {
+		err = json.Unmarshal([]byte(ln), &r)
+		return
+	}
+	parts := strings.Split(ln, " ")
+	if len(parts) < 2 {
+		return r, fmt.Errorf("invalid entry %q", ln)
+	}
+	r.Key = parts[0]
+	for i, part := range parts[1:] {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return r, fmt.Errorf("invalid entry %q: %w", ln, err)
+		}
+		if i == 0 {
+			r.Size = n
+		} else {
+			r.Pages = append(r.Pages, n)
+		}
+	}
+	return r, nil
+}
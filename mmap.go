@@ -20,9 +20,11 @@ func mb(size int) string {
 }
 
 func (this *DB) remmap(fsize int) error {
+	this.mm.Lock()
+	defer this.mm.Unlock()
 	var err error
 	if this.mmap != nil {
-		err = unix.Munmap(this.mmap)
+		err = this.unmap(this.mmap)
 		if err != nil {
 			return fmt.Errorf("munmap: %w", err)
 		}
@@ -33,8 +35,20 @@ func (this *DB) remmap(fsize int) error {
 
 func (this *DB) grow() error {
 	t0 := time.Now()
-	this.max *= 2
-	newSize := this.max * this.pageSize
+	max := int(float64(this.max) * this.opts.GrowFactor)
+	if this.opts.GrowStep > 0 {
+		max = this.max + (this.opts.GrowStep+this.pageSize-1)/this.pageSize
+	}
+	if max <= this.max {
+		max = this.max + 1
+	}
+	if this.opts.MaxSize > 0 && max > this.opts.MaxSize/this.pageSize {
+		max = this.opts.MaxSize / this.pageSize
+		if max <= this.max {
+			return ErrFull
+		}
+	}
+	newSize := max * this.pageSize
 	err := this.data.Truncate(int64(newSize))
 	if err != nil {
 		return fmt.Errorf("truncate: %w", err)
@@ -43,24 +57,47 @@ func (this *DB) grow() error {
 	if err != nil {
 		return fmt.Errorf("mmap: %w", err)
 	}
-	Logger("grow to %s in %v", mb(newSize), time.Since(t0))
+	this.max = max
+	this.logger("grow to %s in %v", mb(newSize), time.Since(t0))
 	return nil
 }
 
-func (this *DB) fetch(size int, pages []int) []byte {
-	out := make([]byte, 0, size)
-	todo := size
-	this.m.Lock()
-	defer this.m.Unlock()
-	for _, page := range pages {
+func (this *DB) fetch(val value) []byte {
+	if val.Inline != nil {
+		return append([]byte{}, val.Inline...)
+	}
+	this.mm.RLock()
+	defer this.mm.RUnlock()
+	return this.read(val)
+}
+
+// copy the value from the index, from its slot, or from its pages one run at the time
+// must be called while holding the lock, or mm for reading
+func (this *DB) read(val value) []byte {
+	out := make([]byte, 0, val.Size)
+	if val.Inline != nil {
+		return append(out, val.Inline...)
+	}
+	if val.Class > 0 {
+		start := val.Slot * val.Class
+		if start+val.Size > len(this.mmap) {
+			return out // a stale value, the file was shrunk after it was read
+		}
+		return append(out, this.mmap[start:start+val.Size]...)
+	}
+	todo := val.Size
+	for _, e := range val.Extents {
 		snap := todo
-		if snap > this.pageSize {
-			snap = this.pageSize
+		if snap > e.Len*this.pageSize {
+			snap = e.Len * this.pageSize
 		}
 		todo -= snap
-		start := page * this.pageSize
+		start := e.Start * this.pageSize
 		end := start + snap
-		//Logger("fetch %d from page %d (%q)", snap, page, string(this.mmap[start:end]))
+		if end > len(this.mmap) {
+			break // a stale value, the file was shrunk after it was read
+		}
+		//Logger("fetch %d from %v (%q)", snap, e, string(this.mmap[start:end]))
 		out = append(out, this.mmap[start:end]...)
 	}
 	return out
@@ -0,0 +1,121 @@
+package goblin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var ErrLocked = errors.New("db is locked by someone else")
+var ErrFull = errors.New("db reached its max size")
+
+// Options for Open, zero values are replaced with the defaults
+type Options struct {
+	// size of the pages in data.db, a power of 2 between 16 bytes and 1MB
+	// it's persisted when the DB is created, and it can't be changed after: 0 means whatever the DB uses (default 256)
+	PageSize int
+
+	// size of data.db when created, default 1MB
+	InitialSize int
+
+	// when data.db is full, it grows by GrowStep bytes if set, otherwise by GrowFactor (default 2)
+	GrowFactor float64
+	GrowStep   int
+	// data.db won't grow past MaxSize bytes, if set: storing more will fail with ErrFull
+	MaxSize int
+
+	// permissions for the new files and directories, default 0666 and 0777 (before umask)
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// how long to wait if the DB is used by someone else, 0 waits forever, negative doesn't wait
+	LockTimeout time.Duration
+
+	// on linux, punch a hole in data.db over each run of at least PunchHoles bytes of free pages, so they don't
+	// take disk space until they are used again: default 0, never
+	PunchHoles int
+
+	// save a checkpoint of the index every CheckpointEvery bytes written to index.log, and on Close
+	// so opening the DB only replays the log after it: default 64MB, negative never
+	CheckpointEvery int
+
+	// compact index.log in background when it has more than CompactRatio stale records per live key
+	// default 0.5, negative never
+	CompactRatio float64
+
+	// values up to InlineSize bytes are kept in the index and in index.log, without taking space in data.db
+	// default 8, negative never
+	InlineSize int
+
+	// default to the package Logger
+	Logger func(f string, args ...any)
+}
+
+func (this *Options) normalize() error {
+	if this.PageSize != 0 {
+		if this.PageSize < 16 || this.PageSize > 1<<20 || this.PageSize&(this.PageSize-1) != 0 {
+			return fmt.Errorf("invalid page size %d", this.PageSize)
+		}
+	}
+	if this.InitialSize <= 0 {
+		this.InitialSize = 1 << 20 // 1MB
+	}
+	if this.MaxSize > 0 && this.InitialSize > this.MaxSize {
+		this.InitialSize = this.MaxSize
+	}
+	if this.GrowFactor == 0 {
+		this.GrowFactor = 2
+	}
+	if this.GrowFactor <= 1 && this.GrowStep <= 0 {
+		return fmt.Errorf("invalid grow factor %v", this.GrowFactor)
+	}
+	if this.CheckpointEvery == 0 {
+		this.CheckpointEvery = 64 << 20 // 64MB
+	}
+	if this.CompactRatio == 0 {
+		this.CompactRatio = 0.5
+	}
+	if this.InlineSize == 0 {
+		this.InlineSize = 8
+	}
+	if this.FileMode == 0 {
+		this.FileMode = 0666
+	}
+	if this.DirMode == 0 {
+		this.DirMode = 0777
+	}
+	if this.Logger == nil {
+		this.Logger = func(f string, args ...any) {
+			Logger(f, args...)
+		}
+	}
+	return nil
+}
+
+// flock the file, waiting at most timeout (forever if 0)
+func lock(f *os.File, timeout time.Duration) error {
+	if timeout == 0 {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX)
+		if err != nil {
+			return fmt.Errorf("can't flock: %w", err)
+		}
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if err != unix.EWOULDBLOCK {
+			return fmt.Errorf("can't flock: %w", err)
+		}
+		if time.Now().After(deadline) {
+			return ErrLocked
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
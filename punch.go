@@ -0,0 +1,62 @@
+package goblin
+
+import (
+	"sort"
+)
+
+// punch holes in data.db over the pages freed since the last time, when they are in a run of free pages longer than
+// Options.PunchHoles, once enough pages have been freed
+// the pages in shorter runs are kept for the next time, since the run may grow, and the ones reused meanwhile are dropped
+// must be called while holding the lock, so the pages can't be reused meanwhile
+func (this *DB) autoPunch(freed extents) {
+	if this.opts.PunchHoles <= 0 || this.noPunch {
+		return
+	}
+	this.toPunch = append(this.toPunch, freed...)
+	this.freed += freed.count()
+	run := (this.opts.PunchHoles + this.pageSize - 1) / this.pageSize
+	if this.freed < run {
+		return
+	}
+	this.freed = 0
+
+	var todo freeList // sorted and merged
+	todo.put(this.toPunch)
+	this.toPunch = this.toPunch[:0]
+	free := this.unused.list
+	holes, bytes := 0, 0
+	for _, p := range todo.list {
+		// the free runs overlapping p, the pages of p outside of them have been reused
+		i := sort.Search(len(free), func(i int) bool {
+			return free[i].end() > p.Start
+		})
+		for ; i < len(free) && free[i].Start < p.end(); i++ {
+			o := p
+			if free[i].Start > o.Start {
+				o.Len -= free[i].Start - o.Start
+				o.Start = free[i].Start
+			}
+			if free[i].end() < o.end() {
+				o.Len = free[i].end() - o.Start
+			}
+			if free[i].Len < run {
+				this.toPunch = append(this.toPunch, o)
+				continue
+			}
+			off := int64(o.Start) * int64(this.pageSize)
+			size := int64(o.Len) * int64(this.pageSize)
+			err := punchHole(this.data, off, size)
+			if err != nil {
+				this.logger("can't punch holes in %q, disabling it: %v", this.dataname, err)
+				this.noPunch = true
+				this.toPunch = nil
+				return
+			}
+			holes++
+			bytes += int(size)
+		}
+	}
+	if holes > 0 {
+		this.logger("punched %d holes, %s", holes, mb(bytes))
+	}
+}
@@ -0,0 +1,12 @@
+package goblin
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// release the disk blocks between off and off+size, which will read as zeros
+func punchHole(f *os.File, off, size int64) error {
+	return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, size)
+}
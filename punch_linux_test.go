@@ -0,0 +1,77 @@
+package goblin_test
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/ohait/goblin"
+)
+
+// disk space used by the file
+func diskUsage(t *testing.T, fname string) int64 {
+	t.Helper()
+	var st syscall.Stat_t
+	noError(t, syscall.Stat(fname, &st))
+	return st.Blocks * 512
+}
+
+func TestPunchHoles(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	// sum what is punched, to check the holes are not punched again
+	var m sync.Mutex
+	punched := 0.0
+	logger := func(f string, args ...any) {
+		var holes int
+		var size float64
+		var unit string
+		if n, _ := fmt.Sscanf(fmt.Sprintf(f, args...), "punched %d holes, %f%s", &holes, &size, &unit); n == 3 {
+			m.Lock()
+			defer m.Unlock()
+			punched += size * map[string]float64{"B": 1, "KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30}[unit]
+		}
+	}
+	// no compactions, their snapshots would delay freeing the pages
+	db, err := goblin.Open("/tmp/test-goblin/", goblin.Options{PunchHoles: 64 << 10, CompactRatio: -1, Logger: logger})
+	noError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		noError(t, db.Store(fmt.Sprint(i), long(64<<10)))
+	}
+	noError(t, db.Sync())
+	used0 := diskUsage(t, "/tmp/test-goblin/data.db")
+
+	for i := 0; i < 90; i++ {
+		noError(t, db.Delete(fmt.Sprint(i)))
+	}
+	used1 := diskUsage(t, "/tmp/test-goblin/data.db")
+	t.Logf("disk usage %d -> %d", used0, used1)
+	if used1 > used0/2 {
+		t.Skipf("no holes were punched, maybe the filesystem doesn't support it: %d -> %d", used0, used1)
+	}
+	m.Lock()
+	total := punched
+	m.Unlock()
+	if total < 90*(64<<10)*0.99 || total > 90*(64<<10)*1.01 {
+		t.Fatalf("expected %d bytes punched, got %.0f", 90*(64<<10), total)
+	}
+
+	// the holes are reused, and filled again
+	for i := 0; i < 90; i++ {
+		noError(t, db.Store(fmt.Sprint(i), []byte(fmt.Sprint(i))))
+	}
+	for i := 0; i < 100; i++ {
+		x, err := db.Fetch(fmt.Sprint(i))
+		noError(t, err)
+		expect := string(long(64 << 10))
+		if i < 90 {
+			expect = fmt.Sprint(i)
+		}
+		if string(x) != expect {
+			t.Fatalf("unexpected value for %d: %d bytes", i, len(x))
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package goblin
+
+import (
+	"errors"
+	"os"
+)
+
+func punchHole(f *os.File, off, size int64) error {
+	return errors.New("hole punching is only supported on linux")
+}
@@ -0,0 +1,122 @@
+package goblin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ohait/goblin/trie"
+)
+
+// extract zero or more index keys from a value
+// it's called while holding the DB lock, so it must not use the DB
+type IndexFunc func(key string, data []byte) []string
+
+// A secondary index, it maps index keys to primary keys
+//
+// Each entry is stored as the escaped index key, "\x00\x00" and the primary key, so the same index key can
+// point to multiple primary keys, and ranges are sorted by index key and then primary key.
+// The NULs in the index key are escaped as "\x00\xff", which keeps the order and can't be taken for the separator.
+type index struct {
+	name string
+	fn   IndexFunc
+	trie trie.Trie[string]   // escaped index key + "\x00\x00" + primary key => primary key
+	back trie.Trie[[]string] // primary key => index keys
+}
+
+// register a new secondary index, and build it from the existing values
+// indexes are not persisted, so they must be added again after each New()
+func (this *DB) AddIndex(name string, fn IndexFunc) error {
+	this.m.Lock()
+	defer this.m.Unlock()
+
+	if _, exists := this.indexes[name]; exists {
+		return fmt.Errorf("index %q already exists", name)
+	}
+	idx := &index{
+		name: name,
+		fn:   fn,
+	}
+	err := this.trie.Range(func(key string, val value) error {
+		data := this.read(val)
+		err := val.verify(key, data, this.pageSize)
+		if err != nil {
+			this.logger("index %q: %v", name, err)
+			return nil
+		}
+		idx.update(key, data, false)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	this.logger("index %q built with %d entries", name, idx.trie.Count())
+
+	if this.indexes == nil {
+		this.indexes = map[string]*index{}
+	}
+	this.indexes[name] = idx
+	return nil
+}
+
+// range thru the values with an index key starting with prefix, sorted by index key
+// a value is returned once for each of its matching index keys
+func (this *DB) RangeIndex(name, prefix string, cb func(Pair) error) error {
+	this.m.Lock()
+	idx := this.indexes[name]
+	this.m.Unlock()
+	if idx == nil {
+		return fmt.Errorf("no index %q", name)
+	}
+
+	return idx.trie.RangePrefix(escape(prefix), func(k string, primary string) error {
+		val := this.trie.Get(primary)
+		if val == nil {
+			return nil // removed in the meantime
+		}
+		return cb(val.pair(primary, this))
+	})
+}
+
+// change the index entries for key, data is ignored if deleted
+// must be called while holding the lock
+func (this *index) update(key string, data []byte, deleted bool) {
+	var keys []string
+	if !deleted {
+		keys = this.fn(key, data)
+	}
+
+	var old []string
+	if len(keys) > 0 {
+		if o := this.back.Put(key, keys); o != nil {
+			old = *o
+		}
+	} else {
+		if o := this.back.Remove(key); o != nil {
+			old = *o
+		}
+	}
+
+	for _, k := range keys {
+		this.trie.Put(escape(k)+"\x00\x00"+key, key)
+	}
+	for _, k := range old {
+		keep := false
+		for _, n := range keys {
+			if n == k {
+				keep = true
+				break
+			}
+		}
+		if !keep {
+			this.trie.Remove(escape(k) + "\x00\x00" + key)
+		}
+	}
+}
+
+// escape the NULs in an index key, see index
+func escape(k string) string {
+	if !strings.Contains(k, "\x00") {
+		return k
+	}
+	return strings.ReplaceAll(k, "\x00", "\x00\xff")
+}
@@ -0,0 +1,100 @@
+package goblin_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ohait/goblin"
+)
+
+func TestIndex(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+
+	// values are "city:tag,tag"
+	byCity := func(key string, data []byte) []string {
+		city, _, _ := strings.Cut(string(data), ":")
+		return []string{city}
+	}
+	byTag := func(key string, data []byte) []string {
+		_, tags, _ := strings.Cut(string(data), ":")
+		if tags == "" {
+			return nil
+		}
+		return strings.Split(tags, ",")
+	}
+
+	noError(t, db.Store("ann", []byte("oslo:red,blue")))
+	noError(t, db.Store("bob", []byte("bergen:blue")))
+	noError(t, db.AddIndex("city", byCity))
+	if db.AddIndex("city", byCity) == nil {
+		t.Fatalf("expected an error for a duplicate index")
+	}
+	noError(t, db.AddIndex("tag", byTag))
+
+	noError(t, db.Store("cid", []byte("oslo:")))
+	noError(t, db.Store("dan", []byte("bergen:red")))
+
+	query := func(name, prefix string) string {
+		t.Helper()
+		var out []string
+		err := db.RangeIndex(name, prefix, func(p goblin.Pair) error {
+			out = append(out, p.Key)
+			return nil
+		})
+		noError(t, err)
+		return strings.Join(out, ",")
+	}
+	equal := func(expect, got string) {
+		t.Helper()
+		if expect != got {
+			t.Fatalf("expected %q, got %q", expect, got)
+		}
+	}
+
+	equal("ann,cid", query("city", "oslo"))
+	equal("bob,dan", query("city", "b"))
+	equal("ann,bob", query("tag", "blue"))
+	equal("ann,dan", query("tag", "red"))
+
+	noError(t, db.Store("ann", []byte("bergen:red")))
+	noError(t, db.Delete("dan"))
+	var b goblin.Batch
+	b.Put("eve", []byte("oslo:blue"))
+	b.Delete("bob")
+	noError(t, db.Write(&b))
+
+	equal("cid,eve", query("city", "oslo"))
+	equal("ann", query("city", "bergen"))
+	equal("eve", query("tag", "blue"))
+	equal("ann", query("tag", "red"))
+	equal("", query("tag", "green"))
+
+	if db.RangeIndex("missing", "", func(goblin.Pair) error { return nil }) == nil {
+		t.Fatalf("expected an error for a missing index")
+	}
+
+	// index keys and primary keys with NULs don't mix up, even when joining them with a NUL would give the same entry
+	noError(t, db.AddIndex("raw", func(key string, data []byte) []string {
+		if strings.HasSuffix(key, "nul") {
+			return []string{string(data)}
+		}
+		return nil
+	}))
+	noError(t, db.Store("nul", []byte("a\x00b")))
+	noError(t, db.Store("b\x00nul", []byte("a")))
+	equal("b\x00nul,nul", query("raw", "a"))
+	equal("nul", query("raw", "a\x00"))
+	noError(t, db.Delete("nul"))
+	equal("b\x00nul", query("raw", "a"))
+
+	// indexes are rebuilt when added again
+	noError(t, db.Close())
+	db, err = goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	defer db.Close()
+	noError(t, db.AddIndex("city", byCity))
+	equal("cid,eve", query("city", "oslo"))
+}
@@ -0,0 +1,277 @@
+package goblin
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// values up to half a page are stored in slots: a page is split in slots of the same size, and each value takes the
+// smallest slot it fits in
+// the sizes are the powers of 2 from minSlot to half a page, bigger values take whole pages
+const minSlot = 16
+
+// the slot size for a value of size bytes, or 0 if it takes whole pages
+func (this *DB) class(size int) int {
+	if size == 0 {
+		return 0
+	}
+	c := minSlot
+	for c < size {
+		c *= 2
+	}
+	if c > this.pageSize/2 {
+		return 0
+	}
+	return c
+}
+
+// a page split in slots
+type slab struct {
+	used  []uint64
+	count int // used slots
+}
+
+// all the slabs with the same slot size
+type sizeClass struct {
+	size  int
+	slabs map[int]*slab // by page
+	avail []int         // pages which may have free slots
+	bytes int           // size of the values in the slots
+	count int           // used slots
+}
+
+// statistics for a size class
+type ClassStats struct {
+	Size  int // of each slot
+	Pages int // split in slots of this size
+	Slots int // in those pages
+	Used  int // slots with a value
+	Bytes int // size of the values in the used slots
+}
+
+// how much of the used slots is wasted
+func (this ClassStats) Waste() float64 {
+	if this.Used == 0 {
+		return 0
+	}
+	return 1 - float64(this.Bytes)/float64(this.Used*this.Size)
+}
+
+func (this ClassStats) String() string {
+	return fmt.Sprintf("%s: %d/%d slots in %d pages, %.0f%% waste", mb(this.Size), this.Used, this.Slots, this.Pages, this.Waste()*100)
+}
+
+// statistics about the space used in data.db
+type Stats struct {
+	Keys     int
+	Pages    int          // in data.db
+	Free     int          // pages not used
+	Classes  []ClassStats // values in slots
+	Large    ClassStats   // values in whole pages, as if each page was a slot
+	Inline   int          // values kept in the index
+	Internal float64      // fraction of the used space which is wasted, for all values
+}
+
+// the statistics, the values in whole pages are counted by scanning all of them
+func (this *DB) Stats() Stats {
+	this.m.Lock()
+	s := Stats{
+		Keys:    this.trie.Count(),
+		Pages:   this.max,
+		Free:    this.unused.len() + this.max - this.next,
+		Classes: this.classStats(),
+	}
+	this.m.Unlock()
+
+	s.Large.Size = this.pageSize
+	_ = this.trie.Range(func(k string, v value) error {
+		if v.Inline != nil {
+			s.Inline++
+		} else if v.Class == 0 && v.Size > 0 {
+			s.Large.Used += v.Extents.count()
+			s.Large.Bytes += v.Size
+		}
+		return nil
+	})
+	s.Large.Pages, s.Large.Slots = s.Large.Used, s.Large.Used
+
+	used, bytes := s.Large.Used*this.pageSize, s.Large.Bytes
+	for _, c := range s.Classes {
+		used += c.Used * c.Size
+		bytes += c.Bytes
+	}
+	if used > 0 {
+		s.Internal = 1 - float64(bytes)/float64(used)
+	}
+	return s
+}
+
+// must be called while holding the lock
+func (this *DB) classStats() []ClassStats {
+	var out []ClassStats
+	for _, c := range this.classes {
+		out = append(out, ClassStats{
+			Size:  c.size,
+			Pages: len(c.slabs),
+			Slots: len(c.slabs) * this.pageSize / c.size,
+			Used:  c.count,
+			Bytes: c.bytes,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Size < out[j].Size
+	})
+	return out
+}
+
+// must be called while holding the lock
+func (this *DB) sizeClass(size int) *sizeClass {
+	c := this.classes[size]
+	if c == nil {
+		if this.classes == nil {
+			this.classes = map[int]*sizeClass{}
+		}
+		c = &sizeClass{size: size, slabs: map[int]*slab{}}
+		this.classes[size] = c
+	}
+	return c
+}
+
+// the pages the value is in, for a value in a slot it's the page of the slot
+func (this value) span(pageSize int) extents {
+	if this.Class > 0 {
+		return extents{{this.Slot * this.Class / pageSize, 1}}
+	}
+	return this.Extents
+}
+
+// find a free slot of the given class for size bytes, in a page before limit (if not negative),
+// or in a new page if none has room
+// must be called while holding the lock
+func (this *DB) allocSlot(class, size, limit int) (int, error) {
+	c := this.sizeClass(class)
+	per := this.pageSize / class
+	page := -1
+	for i := len(c.avail) - 1; i >= 0; i-- {
+		p := c.avail[i]
+		s := c.slabs[p]
+		if s == nil || s.count == per {
+			// stale, drop it
+			c.avail = append(c.avail[:i], c.avail[i+1:]...)
+			continue
+		}
+		if limit < 0 || p < limit {
+			page = p
+			break
+		}
+	}
+	if page < 0 {
+		var pages extents
+		if limit >= 0 {
+			pages = this.unused.take(1, limit)
+		} else {
+			var err error
+			pages, err = this.allocPages(1)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if pages == nil {
+			return 0, ErrFull
+		}
+		page = pages[0].Start
+		c.slabs[page] = &slab{used: make([]uint64, (per+63)/64)}
+		c.avail = append(c.avail, page)
+	}
+	s := c.slabs[page]
+	for i, word := range s.used {
+		if word != ^uint64(0) {
+			bit := bits.TrailingZeros64(^word)
+			s.used[i] |= 1 << bit
+			s.count++
+			c.count++
+			c.bytes += size
+			this.slotSpace += class
+			this.slotBytes += size
+			return page*per + i*64 + bit, nil
+		}
+	}
+	panic("no free slot in a slab with room")
+}
+
+// set the slot as used, and return true if its page was not used before
+// it's used while loading, so the free list is not touched
+// must be called while holding the lock
+func (this *DB) markSlot(val value) bool {
+	c := this.sizeClass(val.Class)
+	per := this.pageSize / val.Class
+	page, i := val.Slot/per, val.Slot%per
+	s := c.slabs[page]
+	fresh := s == nil
+	if fresh {
+		s = &slab{used: make([]uint64, (per+63)/64)}
+		c.slabs[page] = s
+	}
+	if s.used[i/64]&(1<<(i%64)) == 0 {
+		s.used[i/64] |= 1 << (i % 64)
+		s.count++
+		c.count++
+		c.bytes += val.Size
+		this.slotSpace += val.Class
+		this.slotBytes += val.Size
+	}
+	return fresh
+}
+
+// set the slot as free, and return true if its page is not used anymore
+// it doesn't touch the free list, see dispose
+// must be called while holding the lock
+func (this *DB) unmarkSlot(val value) bool {
+	c := this.sizeClass(val.Class)
+	per := this.pageSize / val.Class
+	page, i := val.Slot/per, val.Slot%per
+	s := c.slabs[page]
+	if s == nil || s.used[i/64]&(1<<(i%64)) == 0 {
+		return false
+	}
+	if s.count == per {
+		c.avail = append(c.avail, page)
+	}
+	s.used[i/64] &= ^(uint64(1) << (i % 64))
+	s.count--
+	c.count--
+	c.bytes -= val.Size
+	this.slotSpace -= val.Class
+	this.slotBytes -= val.Size
+	if s.count > 0 {
+		return false
+	}
+	delete(c.slabs, page)
+	return true
+}
+
+// after loading, the slabs with free slots can be used
+// must be called while holding the lock
+func (this *DB) slabsLoaded() {
+	for _, c := range this.classes {
+		c.avail = c.avail[:0]
+		for page, s := range c.slabs {
+			if s.count < this.pageSize/c.size {
+				c.avail = append(c.avail, page)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(c.avail))) // the lowest pages first
+	}
+}
+
+// give back the space used by a value, which nobody can read anymore, and return the pages which are now free
+// must be called while holding the lock
+func (this *DB) dispose(val value) extents {
+	if val.Class > 0 && !this.unmarkSlot(val) {
+		return nil // the page has other slots in use
+	}
+	pages := val.span(this.pageSize)
+	this.unused.put(pages)
+	return pages
+}
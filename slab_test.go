@@ -0,0 +1,104 @@
+package goblin_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ohait/goblin"
+)
+
+func TestSlots(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.Open("/tmp/test-goblin/", goblin.Options{PageSize: 4096})
+	noError(t, err)
+
+	// 10 bytes go in 16 bytes slots, 100 in 128, 1000 in 1K, and 3000 take a whole page
+	sizes := []int{10, 100, 1000, 3000}
+	for i := 0; i < 1000; i++ {
+		noError(t, db.Store(fmt.Sprintf("key-%04d", i), long(sizes[i%4])))
+	}
+
+	s := db.Stats()
+	t.Logf("stats: %+v, %v", s, db)
+	if len(s.Classes) != 3 {
+		t.Fatalf("expected 3 classes, got %v", s.Classes)
+	}
+	for i, size := range []int{16, 128, 1024} {
+		c := s.Classes[i]
+		if c.Size != size || c.Used != 250 || c.Bytes != 250*sizes[i] {
+			t.Fatalf("unexpected class %v", c)
+		}
+		if c.Pages != (250*size+4095)/4096 {
+			t.Fatalf("expected the slots of %d bytes to be packed, got %v", size, c)
+		}
+	}
+	if s.Large.Used != 250 || s.Large.Pages != 250 {
+		t.Fatalf("unexpected large values %v", s.Large)
+	}
+	if w := s.Classes[1].Waste(); w < 0.21 || w > 0.22 {
+		t.Fatalf("expected 100/128 used, got %.2f waste", w)
+	}
+
+	// free some slots, and fill them again
+	for i := 0; i < 1000; i += 8 {
+		noError(t, db.Delete(fmt.Sprintf("key-%04d", i)))
+	}
+	pages := db.Stats().Pages
+	for i := 0; i < 1000; i += 8 {
+		noError(t, db.Store(fmt.Sprintf("key-%04d", i), long(sizes[i%4])))
+	}
+	if db.Stats().Pages != pages {
+		t.Fatalf("expected the free slots to be reused")
+	}
+
+	check := func(db *goblin.DB) {
+		t.Helper()
+		for i := 0; i < 1000; i++ {
+			x, err := db.Fetch(fmt.Sprintf("key-%04d", i))
+			noError(t, err)
+			if string(x) != string(long(sizes[i%4])) {
+				t.Fatalf("expected long(%d) for key-%04d, got %d bytes", sizes[i%4], i, len(x))
+			}
+		}
+	}
+	check(db)
+	noError(t, db.Close())
+
+	// from the checkpoint, and from the log
+	for _, ckpt := range []bool{true, false} {
+		if !ckpt {
+			noError(t, os.Remove("/tmp/test-goblin/index.ckpt"))
+		}
+		db, err = goblin.New("/tmp/test-goblin/")
+		noError(t, err)
+		check(db)
+		if s2 := db.Stats(); fmt.Sprint(s2.Classes) != fmt.Sprint(s.Classes) {
+			t.Fatalf("expected %v after reopening, got %v", s.Classes, s2.Classes)
+		}
+		noError(t, db.Close())
+	}
+
+	report, err := goblin.Verify("/tmp/test-goblin/")
+	noError(t, err)
+	if !report.OK() {
+		t.Fatalf("verify: %v", report)
+	}
+
+	// empty slabs are free pages, and can be dropped
+	db, err = goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		if i%4 != 3 {
+			noError(t, db.Delete(fmt.Sprintf("key-%04d", i)))
+		}
+	}
+	s = db.Stats()
+	if len(s.Classes) != 3 || s.Classes[0].Pages != 0 || s.Classes[1].Pages != 0 || s.Classes[2].Pages != 0 {
+		t.Fatalf("expected no slabs, got %v", s.Classes)
+	}
+	if s.Free < s.Pages-250 {
+		t.Fatalf("expected the slabs to be free, got %+v", s)
+	}
+}
@@ -0,0 +1,282 @@
+package goblin
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"runtime"
+)
+
+var ErrNotFound = errors.New("key not found")
+
+// how much of a streamed value is kept in memory at once
+const streamChunk = 1 << 20 // 1MB
+
+// store the value read from r until EOF, without keeping all of it in memory
+// the pages are allocated as the data comes in, and the value is committed only at EOF: if r fails, nothing is stored
+func (this *DB) StoreFrom(key string, r io.Reader) error {
+	chunk := (streamChunk + this.pageSize - 1) / this.pageSize * this.pageSize
+	buf := make([]byte, chunk)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return this.Store(key, buf[:n]) // it fits in a chunk
+	}
+	if err != nil {
+		return err
+	}
+
+	var pages extents
+	size := 0
+	sum := uint32(0)
+	release := func() {
+		this.m.Lock()
+		defer this.m.Unlock()
+		this.unused.put(pages) // never used, so nobody can be reading them
+	}
+	write := func(data []byte) error {
+		this.m.Lock()
+		defer this.m.Unlock()
+		more, err := this.allocPages((len(data) + this.pageSize - 1) / this.pageSize)
+		if err != nil {
+			this.logger("grow error: %v", err)
+			return err
+		}
+		this.write(data, more)
+		pages = pages.append(more)
+		size += len(data)
+		sum = crc32.Update(sum, castagnoli, data)
+		return nil
+	}
+	for err == nil {
+		err = write(buf[:n])
+		if err != nil {
+			release()
+			return err
+		}
+		n, err = io.ReadFull(r, buf)
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = write(buf[:n])
+	}
+	if err != nil && err != io.EOF {
+		release()
+		return err
+	}
+
+	this.m.Lock()
+	defer this.m.Unlock()
+	rec := record{Key: key, Size: size, Extents: pages, CRC: &sum, Version: this.seq + 1}
+	if len(this.indexes) > 0 {
+		rec.data = this.read(rec.val()) // the indexes need the whole value
+	}
+	err = this.writeLog(rec)
+	if err != nil {
+		this.unused.put(pages)
+		return err
+	}
+	this.commit(rec)
+	return nil
+}
+
+// read the value of key, as it is now, without loading it all in memory
+// the pages are read only when needed, and they are not reused until the reader is closed
+// a reader which is not closed keeps them until it's garbage collected
+func (this *DB) Open(key string) (*Reader, error) {
+	this.m.Lock()
+	defer this.m.Unlock()
+	val := this.trie.Get(key)
+	if val == nil {
+		return nil, fmt.Errorf("%q: %w", key, ErrNotFound)
+	}
+	if l, ok := val.loc(); ok {
+		o := this.readers[l]
+		if o == nil {
+			o = &opened{val: *val}
+			if this.readers == nil {
+				this.readers = map[loc]*opened{}
+			}
+			this.readers[l] = o
+		}
+		o.n++
+	}
+	r := &Reader{db: this, key: key, val: *val}
+	runtime.SetFinalizer(r, func(r *Reader) {
+		r.db.logger("reader of %q not closed", r.key)
+		_ = r.Close()
+	})
+	return r, nil
+}
+
+// where a value is in data.db
+type loc struct {
+	class, slot, page int
+}
+
+// the location of the value, false if it's not in data.db
+func (this value) loc() (loc, bool) {
+	switch {
+	case this.Inline != nil:
+		return loc{}, false
+	case this.Class > 0:
+		return loc{class: this.Class, slot: this.Slot}, true
+	case len(this.Extents) > 0:
+		return loc{page: this.Extents[0].Start}, true
+	}
+	return loc{}, false
+}
+
+// a value open by some readers
+type opened struct {
+	val   value
+	n     int  // open readers
+	freed bool // replaced or deleted, the space is freed when the last reader is closed
+}
+
+// must be called while holding the lock
+func (this *DB) closeReader(val value) {
+	l, ok := val.loc()
+	if !ok {
+		return
+	}
+	o := this.readers[l]
+	o.n--
+	if o.n > 0 {
+		return
+	}
+	delete(this.readers, l)
+	if o.freed {
+		this.free(o.val)
+	}
+}
+
+// a value being read, see DB.Open
+type Reader struct {
+	db     *DB
+	key    string
+	val    value
+	off    int64
+	closed bool
+
+	// the checksum is verified when the value is read sequentially
+	sum    uint32
+	summed int64
+}
+
+var _ io.ReadSeekCloser = &Reader{}
+var _ io.ReaderAt = &Reader{}
+
+func (this *Reader) Size() int64 {
+	return int64(this.val.Size)
+}
+
+func (this *Reader) Version() uint64 {
+	return this.val.Version
+}
+
+func (this *Reader) Close() error {
+	if this.closed {
+		return os.ErrClosed
+	}
+	this.closed = true
+	runtime.SetFinalizer(this, nil)
+	this.db.m.Lock()
+	defer this.db.m.Unlock()
+	this.db.closeReader(this.val)
+	return nil
+}
+
+func (this *Reader) Read(p []byte) (int, error) {
+	n, err := this.ReadAt(p, this.off)
+	if this.off == this.summed {
+		this.sum = crc32.Update(this.sum, castagnoli, p[:n])
+		this.summed += int64(n)
+		if this.summed == this.Size() && this.val.HasCRC && this.sum != this.val.CRC {
+			return n, this.val.corrupt(this.key, this.sum, this.db.pageSize)
+		}
+	}
+	this.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil // the next Read will return it
+	}
+	return n, err
+}
+
+func (this *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += this.off
+	case io.SeekEnd:
+		offset += this.Size()
+	default:
+		return this.off, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return this.off, fmt.Errorf("negative offset %d", offset)
+	}
+	this.off = offset
+	return offset, nil
+}
+
+func (this *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if this.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= this.Size() {
+		return 0, io.EOF
+	}
+	want := len(p)
+	if rest := this.Size() - off; int64(want) > rest {
+		want = int(rest)
+	}
+
+	n := 0
+	if this.val.Inline != nil {
+		n = copy(p[:want], this.val.Inline[off:])
+	} else {
+		this.db.mm.RLock()
+		n = this.db.readAt(p[:want], int(off), this.val)
+		this.db.mm.RUnlock()
+	}
+	if n < want {
+		return n, io.ErrUnexpectedEOF // the file is shorter than the value
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// copy the part of the value starting at off into p, walking its slot or its pages
+// must be called while holding the lock, or mm for reading
+func (this *DB) readAt(p []byte, off int, val value) int {
+	if val.Class > 0 {
+		start := val.Slot*val.Class + off
+		if start+len(p) > len(this.mmap) {
+			return 0
+		}
+		return copy(p, this.mmap[start:])
+	}
+	n := 0
+	pos := 0 // in the value, where the current run starts
+	for _, e := range val.Extents {
+		l := e.Len * this.pageSize
+		if n < len(p) && off < pos+l {
+			start := e.Start*this.pageSize + off - pos
+			end := e.end() * this.pageSize
+			if end > len(this.mmap) {
+				return n
+			}
+			ct := copy(p[n:], this.mmap[start:end])
+			n += ct
+			off += ct
+		}
+		pos += l
+	}
+	return n
+}
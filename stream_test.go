@@ -0,0 +1,133 @@
+package goblin_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"testing/iotest"
+
+	"github.com/ohait/goblin"
+)
+
+// a reader of size bytes which doesn't keep them in memory
+type pattern struct {
+	off, size int64
+}
+
+func (this *pattern) Read(p []byte) (int, error) {
+	if this.off >= this.size {
+		return 0, io.EOF
+	}
+	if rest := this.size - this.off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	for i := range p {
+		p[i] = byte((this.off + int64(i)) % 251)
+	}
+	this.off += int64(len(p))
+	return len(p), nil
+}
+
+func TestStream(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+
+	size := int64(5<<20 + 123)
+	noError(t, db.StoreFrom("blob", &pattern{size: size}))
+	noError(t, db.StoreFrom("small", bytes.NewReader(long(100))))
+
+	check := func(db *goblin.DB) {
+		t.Helper()
+		r, err := db.Open("blob")
+		noError(t, err)
+		defer r.Close()
+		if r.Size() != size {
+			t.Fatalf("expected %d bytes, got %d", size, r.Size())
+		}
+		// read it all, in small and odd sized reads
+		err = iotest.TestReader(r, mustRead(t, &pattern{size: size}))
+		noError(t, err)
+
+		p := make([]byte, 1000)
+		n, err := r.ReadAt(p, size-10)
+		if n != 10 || err != io.EOF || !bytes.Equal(p[:10], mustRead(t, &pattern{size: size})[size-10:]) {
+			t.Fatalf("unexpected ReadAt at the end: %d, %v", n, err)
+		}
+
+		x, err := db.Fetch("small")
+		noError(t, err)
+		if string(x) != string(long(100)) {
+			t.Fatalf("expected long(100), got %d bytes", len(x))
+		}
+		r2, err := db.Open("small")
+		noError(t, err)
+		defer r2.Close()
+		x, err = io.ReadAll(r2)
+		noError(t, err)
+		if string(x) != string(long(100)) {
+			t.Fatalf("expected long(100), got %d bytes", len(x))
+		}
+	}
+	check(db)
+
+	// the reader keeps seeing the value it opened
+	r, err := db.Open("blob")
+	noError(t, err)
+	noError(t, db.StoreFrom("blob", &pattern{size: size / 2}))
+	noError(t, db.StoreFrom("other", &pattern{size: size}))
+	n, err := io.Copy(io.Discard, r)
+	noError(t, err)
+	if n != size {
+		t.Fatalf("expected %d bytes, got %d", size, n)
+	}
+	noError(t, r.Close())
+	noError(t, db.StoreFrom("blob", &pattern{size: size}))
+
+	// the reader only keeps its own value, the space of the others is reused
+	r, err = db.Open("blob")
+	noError(t, err)
+	pages := db.Stats().Pages
+	for i := 0; i < 100; i++ {
+		noError(t, db.Store("other", long(100000)))
+	}
+	if grown := (db.Stats().Pages - pages) * 256; grown > 10*100000 {
+		t.Fatalf("data.db grew by %d bytes while a reader was open", grown)
+	}
+	noError(t, r.Close())
+
+	// if the reader fails, nothing is stored, and the pages are given back
+	free := db.Stats().Free
+	fail := errors.New("fail")
+	err = db.StoreFrom("broken", io.MultiReader(&pattern{size: 3 << 20}, iotest.ErrReader(fail)))
+	if err != fail {
+		t.Fatalf("expected %v, got %v", fail, err)
+	}
+	if _, err := db.Open("broken"); !errors.Is(err, goblin.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if s := db.Stats(); s.Free != free {
+		t.Fatalf("expected %d free pages, got %d", free, s.Free)
+	}
+	noError(t, db.Close())
+
+	db, err = goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	check(db)
+	noError(t, db.Close())
+
+	report, err := goblin.Verify("/tmp/test-goblin/")
+	noError(t, err)
+	if !report.OK() {
+		t.Fatalf("verify: %v", report)
+	}
+}
+
+func mustRead(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	x, err := io.ReadAll(r)
+	noError(t, err)
+	return x
+}
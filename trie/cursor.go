@@ -0,0 +1,73 @@
+package trie
+
+// A position in the trie, which can be moved back and forth
+//
+// The cursor only keeps the current key, so it's not affected by concurrent changes,
+// and each move costs a descent from the root.
+type Cursor[T any] struct {
+	trie *Trie[T]
+	key  string
+	val  *T // nil if not positioned
+}
+
+func (this *Trie[T]) Cursor() *Cursor[T] {
+	return &Cursor[T]{trie: this}
+}
+
+// the current key and value, val is nil if the cursor is not positioned
+func (this *Cursor[T]) Current() (key string, val *T) {
+	return this.key, this.val
+}
+
+// move to the first key
+func (this *Cursor[T]) First() (string, *T) {
+	return this.Seek("")
+}
+
+// move to the last key
+func (this *Cursor[T]) Last() (string, *T) {
+	this.set(this.trie.RangeReverse)
+	return this.key, this.val
+}
+
+// move to the first key equal or after k
+func (this *Cursor[T]) Seek(k string) (string, *T) {
+	this.set(func(f func(string, T) error) error {
+		return this.trie.RangeBetween(k, "", f)
+	})
+	return this.key, this.val
+}
+
+// move to the next key, return a nil val if there is none
+func (this *Cursor[T]) Next() (string, *T) {
+	if this.val == nil {
+		return "", nil
+	}
+	// "\x00" is the smallest possible suffix
+	return this.Seek(this.key + "\x00")
+}
+
+// move to the previous key, return a nil val if there is none
+func (this *Cursor[T]) Prev() (string, *T) {
+	if this.val == nil {
+		return "", nil
+	}
+	if this.key == "" {
+		this.val = nil // nothing before the empty key
+		return "", nil
+	}
+	k := this.key
+	this.set(func(f func(string, T) error) error {
+		return this.trie.RangeBetweenReverse("", k, f)
+	})
+	return this.key, this.val
+}
+
+// move to the first key returned by range_
+func (this *Cursor[T]) set(range_ func(func(string, T) error) error) {
+	this.key, this.val = "", nil
+	_ = range_(func(k string, val T) error {
+		this.key, this.val = k, &val
+		return EOD
+	})
+}
@@ -0,0 +1,48 @@
+package trie_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ohait/goblin/trie"
+)
+
+func TestCursor(t *testing.T) {
+	var x trie.Trie[int]
+	c := x.Cursor()
+	_, v := c.First()
+	assert(t, v == nil, "empty")
+	_, v = c.Next()
+	assert(t, v == nil, "empty")
+
+	for i, k := range []string{"", "a", "ab", "abc", "ac", "b", "ba", "removed"} {
+		x.Put(k, i)
+	}
+	x.Remove("removed")
+
+	var out []string
+	for k, v := c.First(); v != nil; k, v = c.Next() {
+		out = append(out, "<"+k+">")
+	}
+	equal(t, "<>,<a>,<ab>,<abc>,<ac>,<b>,<ba>", strings.Join(out, ","))
+
+	out = nil
+	for k, v := c.Last(); v != nil; k, v = c.Prev() {
+		out = append(out, "<"+k+">")
+	}
+	equal(t, "<ba>,<b>,<ac>,<abc>,<ab>,<a>,<>", strings.Join(out, ","))
+
+	k, v := c.Seek("abb")
+	equal(t, "abc 3", fmt.Sprint(k, " ", *v))
+	k, _ = c.Prev()
+	equal(t, "ab", k)
+	k, _ = c.Next()
+	equal(t, "abc", k)
+	k, _ = c.Next()
+	equal(t, "ac", k)
+	_, v = c.Seek("c")
+	assert(t, v == nil, "seek past the end")
+	_, v = c.Next()
+	assert(t, v == nil, "next past the end")
+}
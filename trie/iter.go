@@ -0,0 +1,51 @@
+//go:build go1.23
+
+package trie
+
+import "iter"
+
+// iterate over all the key/values in lexycographic order
+func (this *Trie[T]) All() iter.Seq2[string, T] {
+	return func(yield func(string, T) bool) {
+		_ = this.Range(func(k string, val T) error {
+			if !yield(k, val) {
+				return EOD
+			}
+			return nil
+		})
+	}
+}
+
+// iterate over all the key/values in reverse lexycographic order
+func (this *Trie[T]) Backward() iter.Seq2[string, T] {
+	return func(yield func(string, T) bool) {
+		_ = this.RangeReverse(func(k string, val T) error {
+			if !yield(k, val) {
+				return EOD
+			}
+			return nil
+		})
+	}
+}
+
+// iterate from the current position (included) to the end, moving the cursor
+func (this *Cursor[T]) Forward() iter.Seq2[string, T] {
+	return func(yield func(string, T) bool) {
+		for k, v := this.Current(); v != nil; k, v = this.Next() {
+			if !yield(k, *v) {
+				return
+			}
+		}
+	}
+}
+
+// iterate from the current position (included) to the beginning, moving the cursor
+func (this *Cursor[T]) Backward() iter.Seq2[string, T] {
+	return func(yield func(string, T) bool) {
+		for k, v := this.Current(); v != nil; k, v = this.Prev() {
+			if !yield(k, *v) {
+				return
+			}
+		}
+	}
+}
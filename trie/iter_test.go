@@ -0,0 +1,47 @@
+//go:build go1.23
+
+package trie_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ohait/goblin/trie"
+)
+
+func TestIter(t *testing.T) {
+	var x trie.Trie[int]
+	for i, k := range []string{"a", "ab", "b", "c"} {
+		x.Put(k, i)
+	}
+	var out []string
+	for k := range x.All() {
+		out = append(out, k)
+	}
+	equal(t, "a,ab,b,c", strings.Join(out, ","))
+
+	out = nil
+	for k := range x.Backward() {
+		if k == "a" {
+			break
+		}
+		out = append(out, k)
+	}
+	equal(t, "c,b,ab", strings.Join(out, ","))
+
+	c := x.Cursor()
+	c.Seek("aa")
+	out = nil
+	for k, v := range c.Forward() {
+		out = append(out, k)
+		if v == 2 {
+			break
+		}
+	}
+	equal(t, "ab,b", strings.Join(out, ","))
+	out = nil
+	for k := range c.Backward() {
+		out = append(out, k)
+	}
+	equal(t, "b,ab,a", strings.Join(out, ","))
+}
@@ -86,8 +86,9 @@ func (this *node[T]) put(k []byte, val T) (old *T) {
 func (this *node[T]) get(k []byte) *T {
 	this.m.Lock()
 	if len(k) == 0 {
+		val := this.val
 		this.m.Unlock()
-		return this.val
+		return val
 	}
 	if len(this.children) == 0 {
 		this.m.Unlock()
@@ -143,26 +144,175 @@ func (this *node[T]) delete(k []byte) (old *T) {
 	return nil
 }
 
+// the child for char, or nil
+// must be called while holding the lock
+func (this *node[T]) child(char byte) *node[T] {
+	for _, child := range this.children {
+		if child.ch == char {
+			return child.node
+		}
+	}
+	return nil
+}
+
+// descend to the node for the given key, or nil if there is none
+func (this *node[T]) find(k []byte) *node[T] {
+	n := this
+	for _, char := range k {
+		n.m.Lock()
+		next := n.child(char)
+		n.m.Unlock()
+		if next == nil {
+			return nil
+		}
+		n = next
+	}
+	return n
+}
+
+// a bound for range_, relative to the current node
+// inactive when the keys below the node are all on the right side of it
+type bound struct {
+	active bool
+	rest   []byte // what's left of the bound after the current node
+}
+
+func (this bound) next(char byte) bound {
+	if this.active && len(this.rest) > 0 && this.rest[0] == char {
+		return bound{true, this.rest[1:]}
+	}
+	return bound{}
+}
+
 func (this *node[T]) range_(prefix []byte, f func(k []byte, val T) error) (err error) {
-	var list = make([]child[T], len(this.children))
+	return this.between(prefix, bound{}, bound{}, f)
+}
 
+// range over the keys in [lo, hi)
+func (this *node[T]) between(prefix []byte, lo, hi bound, f func(k []byte, val T) error) (err error) {
 	this.m.Lock()
 	val := this.val
+	list := make([]child[T], len(this.children))
 	copy(list, this.children)
 	this.m.Unlock()
 
-	if val != nil {
-		err := f(prefix, *this.val)
+	if hi.active && len(hi.rest) == 0 {
+		return nil // this is hi, and the children are after it
+	}
+	if val != nil && (!lo.active || len(lo.rest) == 0) {
+		err := f(prefix, *val)
 		if err != nil {
 			return err
 		}
 	}
 	for _, child := range list {
+		if lo.active && len(lo.rest) > 0 && child.ch < lo.rest[0] {
+			continue
+		}
+		if hi.active && child.ch > hi.rest[0] {
+			break
+		}
+		if child.node.count.Get() == 0 {
+			continue // only removed keys
+		}
 		k := append(prefix, byte(child.ch))
-		err = child.node.range_(k, f)
+		err = child.node.between(k, lo.next(child.ch), hi.next(child.ch), f)
 		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// like between, but in reverse order: children from last to first, and then the node itself
+func (this *node[T]) betweenReverse(prefix []byte, lo, hi bound, f func(k []byte, val T) error) (err error) {
+	this.m.Lock()
+	val := this.val
+	list := make([]child[T], len(this.children))
+	copy(list, this.children)
+	this.m.Unlock()
+
+	if hi.active && len(hi.rest) == 0 {
+		return nil // this is hi, and the children are after it
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		child := list[i]
+		if hi.active && child.ch > hi.rest[0] {
+			continue
+		}
+		if lo.active && len(lo.rest) > 0 && child.ch < lo.rest[0] {
+			break
+		}
+		if child.node.count.Get() == 0 {
+			continue // only removed keys
+		}
+		k := append(prefix, byte(child.ch))
+		err = child.node.betweenReverse(k, lo.next(child.ch), hi.next(child.ch), f)
+		if err != nil {
+			return err
+		}
+	}
+	if val != nil && (!lo.active || len(lo.rest) == 0) {
+		return f(prefix, *val)
+	}
+	return nil
+}
+
+// how many keys are before k
+func (this *node[T]) rank(k []byte) int {
+	ct := 0
+	n := this
+	for _, char := range k {
+		n.m.Lock()
+		if n.val != nil {
+			ct++ // a prefix of k comes before k
+		}
+		var next *node[T]
+		for _, child := range n.children {
+			if child.ch >= char {
+				if child.ch == char {
+					next = child.node
+				}
+				break
+			}
+			ct += child.node.count.Get()
+		}
+		n.m.Unlock()
+		if next == nil {
+			return ct
+		}
+		n = next
+	}
+	return ct
+}
+
+// the i-th key (starting from 0) and its value, or nil if there are not enough keys
+func (this *node[T]) nth(prefix []byte, i int) ([]byte, *T) {
+	n := this
+	for {
+		n.m.Lock()
+		if n.val != nil {
+			if i == 0 {
+				val := n.val
+				n.m.Unlock()
+				return prefix, val
+			}
+			i--
+		}
+		var next *node[T]
+		for _, child := range n.children {
+			ct := child.node.count.Get()
+			if i < ct {
+				next = child.node
+				prefix = append(prefix, child.ch)
+				break
+			}
+			i -= ct
+		}
+		n.m.Unlock()
+		if next == nil {
+			return nil, nil
+		}
+		n = next
+	}
+}
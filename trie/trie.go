@@ -46,3 +46,110 @@ func (this *Trie[T]) Range(f func(string, T) error) error {
 	}
 	return err
 }
+
+// Ranges over all the keys starting with prefix, in lexycographic order
+func (this *Trie[T]) RangePrefix(prefix string, f func(string, T) error) error {
+	n := this.root.find([]byte(prefix))
+	if n == nil {
+		return nil
+	}
+	k := make([]byte, 0, 1024)
+	k = append(k, prefix...)
+	err := n.range_(k, func(k []byte, val T) error {
+		return f(string(k), val)
+	})
+	if err == EOD {
+		return nil
+	}
+	return err
+}
+
+// Ranges over the keys from start (included) to end (excluded), in lexycographic order
+// if end is empty, there is no upper limit
+func (this *Trie[T]) RangeBetween(start, end string, f func(string, T) error) error {
+	lo := bound{true, []byte(start)}
+	hi := bound{end != "", []byte(end)}
+	k := make([]byte, 0, 1024)
+	err := this.root.between(k, lo, hi, func(k []byte, val T) error {
+		return f(string(k), val)
+	})
+	if err == EOD {
+		return nil
+	}
+	return err
+}
+
+// Ranges over all the key/values in reverse lexycographic order
+func (this *Trie[T]) RangeReverse(f func(string, T) error) error {
+	return this.RangeBetweenReverse("", "", f)
+}
+
+// Ranges over all the keys starting with prefix, in reverse lexycographic order
+func (this *Trie[T]) RangePrefixReverse(prefix string, f func(string, T) error) error {
+	n := this.root.find([]byte(prefix))
+	if n == nil {
+		return nil
+	}
+	k := make([]byte, 0, 1024)
+	k = append(k, prefix...)
+	err := n.betweenReverse(k, bound{}, bound{}, func(k []byte, val T) error {
+		return f(string(k), val)
+	})
+	if err == EOD {
+		return nil
+	}
+	return err
+}
+
+// Ranges over the keys from end (excluded) down to start (included), in reverse lexycographic order
+// if end is empty, there is no upper limit
+func (this *Trie[T]) RangeBetweenReverse(start, end string, f func(string, T) error) error {
+	lo := bound{true, []byte(start)}
+	hi := bound{end != "", []byte(end)}
+	k := make([]byte, 0, 1024)
+	err := this.root.betweenReverse(k, lo, hi, func(k []byte, val T) error {
+		return f(string(k), val)
+	})
+	if err == EOD {
+		return nil
+	}
+	return err
+}
+
+// how many keys start with prefix
+func (this *Trie[T]) CountPrefix(prefix string) int {
+	n := this.root.find([]byte(prefix))
+	if n == nil {
+		return 0
+	}
+	return n.count.Get()
+}
+
+// how many keys are between start (included) and end (excluded)
+// if end is empty, there is no upper limit
+func (this *Trie[T]) CountRange(start, end string) int {
+	hi := this.Count()
+	if end != "" {
+		hi = this.Rank(end)
+	}
+	ct := hi - this.Rank(start)
+	if ct < 0 {
+		return 0
+	}
+	return ct
+}
+
+// the position of key in lexycographic order, which is how many keys come before it
+// the key doesn't need to exist
+func (this *Trie[T]) Rank(key string) int {
+	return this.root.rank([]byte(key))
+}
+
+// the key and value at position i in lexycographic order, val is nil if out of range
+func (this *Trie[T]) Nth(i int) (key string, val *T) {
+	if i < 0 {
+		return "", nil
+	}
+	k, val := this.root.nth(make([]byte, 0, 64), i)
+	return string(k), val
+}
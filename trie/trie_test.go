@@ -83,6 +83,142 @@ func TestTrie(t *testing.T) {
 	assert(t, x.Get("a1") == nil, "a1")
 }
 
+func TestRangePrefix(t *testing.T) {
+	var x trie.Trie[int]
+	for i, k := range []string{"a", "ab", "abc", "abd", "ac", "b", "ba"} {
+		x.Put(k, i)
+	}
+	list := func(prefix string) string {
+		var out []string
+		err := x.RangePrefix(prefix, func(k string, v int) error {
+			out = append(out, k)
+			return nil
+		})
+		assert(t, err == nil, "err: %v", err)
+		return strings.Join(out, ",")
+	}
+	equal(t, "a,ab,abc,abd,ac,b,ba", list(""))
+	equal(t, "ab,abc,abd", list("ab"))
+	equal(t, "abc", list("abc"))
+	equal(t, "b,ba", list("b"))
+	equal(t, "", list("abx"))
+	equal(t, "", list("c"))
+}
+
+func TestRangeBetween(t *testing.T) {
+	var x trie.Trie[int]
+	for i, k := range []string{"a", "ab", "abc", "abd", "ac", "b", "ba"} {
+		x.Put(k, i)
+	}
+	list := func(start, end string) string {
+		var out []string
+		err := x.RangeBetween(start, end, func(k string, v int) error {
+			out = append(out, k)
+			return nil
+		})
+		assert(t, err == nil, "err: %v", err)
+		return strings.Join(out, ",")
+	}
+	equal(t, "a,ab,abc,abd,ac,b,ba", list("", ""))
+	equal(t, "ab,abc,abd,ac", list("ab", "b"))
+	equal(t, "abc,abd,ac,b", list("abb", "b0"))
+	equal(t, "a,ab", list("", "abc"))
+	equal(t, "ac,b,ba", list("ac", ""))
+	equal(t, "", list("ab", "ab"))
+	equal(t, "", list("c", ""))
+
+	ct := 0
+	err := x.RangeBetween("ab", "", func(k string, v int) error {
+		ct++
+		return trie.EOD
+	})
+	assert(t, err == nil, "EOD")
+	equal(t, 1, ct)
+}
+
+func TestRangeReverse(t *testing.T) {
+	var x trie.Trie[int]
+	for i, k := range []string{"a", "ab", "abc", "abd", "ac", "b", "ba"} {
+		x.Put(k, i)
+	}
+	list := func(cb func(func(string, int) error) error) string {
+		var out []string
+		err := cb(func(k string, v int) error {
+			out = append(out, k)
+			return nil
+		})
+		assert(t, err == nil, "err: %v", err)
+		return strings.Join(out, ",")
+	}
+	equal(t, "ba,b,ac,abd,abc,ab,a", list(x.RangeReverse))
+	prefix := func(p string) func(func(string, int) error) error {
+		return func(f func(string, int) error) error {
+			return x.RangePrefixReverse(p, f)
+		}
+	}
+	equal(t, "abd,abc,ab", list(prefix("ab")))
+	equal(t, "ba,b", list(prefix("b")))
+	equal(t, "", list(prefix("c")))
+	between := func(start, end string) func(func(string, int) error) error {
+		return func(f func(string, int) error) error {
+			return x.RangeBetweenReverse(start, end, f)
+		}
+	}
+	equal(t, "ac,abd,abc,ab", list(between("ab", "b")))
+	equal(t, "b,ac,abd,abc", list(between("abb", "b0")))
+	equal(t, "ba,b,ac", list(between("ac", "")))
+	equal(t, "", list(between("ab", "ab")))
+
+	// latest 2
+	var out []string
+	err := x.RangeReverse(func(k string, v int) error {
+		out = append(out, k)
+		if len(out) == 2 {
+			return trie.EOD
+		}
+		return nil
+	})
+	assert(t, err == nil, "EOD")
+	equal(t, "ba,b", strings.Join(out, ","))
+}
+
+func TestRank(t *testing.T) {
+	var x trie.Trie[int]
+	keys := []string{"", "a", "ab", "abc", "abd", "ac", "b", "ba"}
+	for i, k := range keys {
+		x.Put(k, i)
+	}
+	x.Put("removed", -1)
+	x.Remove("removed")
+
+	for i, k := range keys {
+		equal(t, i, x.Rank(k))
+		nk, v := x.Nth(i)
+		equal(t, k, nk)
+		equal(t, i, *v)
+	}
+	_, v := x.Nth(len(keys))
+	assert(t, v == nil, "nth out of range")
+	_, v = x.Nth(-1)
+	assert(t, v == nil, "nth out of range")
+
+	equal(t, 3, x.Rank("abb"))
+	equal(t, 8, x.Rank("c"))
+	equal(t, 6, x.Rank("b"))
+	equal(t, 8, x.Rank("removed"))
+
+	equal(t, 8, x.CountPrefix(""))
+	equal(t, 5, x.CountPrefix("a"))
+	equal(t, 3, x.CountPrefix("ab"))
+	equal(t, 0, x.CountPrefix("abx"))
+	equal(t, 0, x.CountPrefix("removed"))
+
+	equal(t, 4, x.CountRange("ab", "b"))
+	equal(t, 4, x.CountRange("abb", "b0"))
+	equal(t, 3, x.CountRange("ac", ""))
+	equal(t, 0, x.CountRange("b", "a"))
+}
+
 func TestMem(t *testing.T) {
 	SIZE := 100000
 	var x trie.Trie[int]
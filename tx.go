@@ -0,0 +1,365 @@
+package goblin
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/ohait/goblin/trie"
+)
+
+var ErrTxClosed = errors.New("transaction closed")
+var ErrTxReadOnly = errors.New("read-only transaction")
+
+// A consistent view of the DB, see DB.View and DB.Update
+//
+// Reads see the DB as it was when the transaction started, regardless of concurrent writes.
+// Writes are buffered and committed atomically when the Update function returns, unless some key the transaction
+// read or wrote was changed by someone else in the meantime.
+type Tx struct {
+	db     *DB
+	snap   *snapshot
+	batch  *Batch             // nil for read-only transactions
+	writes map[string]*[]byte // pending writes, nil for deletes
+	reads  map[string]bool    // keys read, only for read-write transactions
+	closed bool
+}
+
+// run fn in a read-only transaction
+// Pairs must not be fetched after fn returns
+func (this *DB) View(fn func(tx *Tx) error) error {
+	tx := &Tx{
+		db:   this,
+		snap: this.snapshot(),
+	}
+	defer tx.close()
+	return fn(tx)
+}
+
+// run fn in a read-write transaction, the changes are committed only if fn returns nil
+// Updates are serialized between themselves, but plain Store and Delete can still
+// interleave with them: if they change a key the transaction read or wrote, nothing is committed
+// and ErrConflict is returned
+func (this *DB) Update(fn func(tx *Tx) error) error {
+	this.txm.Lock()
+	defer this.txm.Unlock()
+
+	tx := &Tx{
+		db:     this,
+		snap:   this.snapshot(),
+		batch:  &Batch{},
+		writes: map[string]*[]byte{},
+		reads:  map[string]bool{},
+	}
+	defer tx.close()
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+
+	this.m.Lock()
+	defer this.m.Unlock()
+	err = tx.conflict()
+	if err != nil {
+		return err
+	}
+	return this.writeBatch(tx.batch)
+}
+
+// return ErrConflict if a key read or written was changed after the snapshot
+// must be called while holding the lock
+func (this *Tx) conflict() error {
+	check := func(key string) error {
+		old, changed := this.snap.lookup(key)
+		if !changed {
+			return nil
+		}
+		// Defrag moves the values keeping their versions, that's not a change
+		err := ErrConflict{Key: key}
+		if old != nil {
+			err.Expected = old.Version
+		}
+		cur := this.db.trie.Get(key)
+		if cur != nil {
+			err.Actual = cur.Version
+		}
+		if (old == nil) == (cur == nil) && err.Expected == err.Actual {
+			return nil
+		}
+		return err
+	}
+	for key := range this.reads {
+		if err := check(key); err != nil {
+			return err
+		}
+	}
+	for key := range this.writes {
+		if err := check(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *Tx) close() {
+	if !this.closed {
+		this.closed = true
+		this.db.release(this.snap)
+	}
+}
+
+func (this *Tx) Writable() bool {
+	return this.batch != nil
+}
+
+// return the value for key, or nil if missing
+func (this *Tx) Fetch(key string) ([]byte, error) {
+	if this.closed {
+		return nil, ErrTxClosed
+	}
+	if w, ok := this.writes[key]; ok {
+		if w == nil {
+			return nil, nil
+		}
+		return *w, nil
+	}
+	if this.reads != nil {
+		this.reads[key] = true
+	}
+	val := this.snap.get(this.db, key)
+	if val == nil {
+		return nil, nil
+	}
+	return this.db.load(key, *val)
+}
+
+func (this *Tx) Store(key string, data []byte) error {
+	if this.closed {
+		return ErrTxClosed
+	}
+	if this.batch == nil {
+		return ErrTxReadOnly
+	}
+	this.batch.Put(key, data)
+	this.writes[key] = &data
+	return nil
+}
+
+func (this *Tx) Delete(key string) error {
+	if this.closed {
+		return ErrTxClosed
+	}
+	if this.batch == nil {
+		return ErrTxReadOnly
+	}
+	this.batch.Delete(key)
+	this.writes[key] = nil
+	return nil
+}
+
+// range thru all the keys as seen by this transaction, in lexicographic order
+func (this *Tx) Range(cb func(Pair) error) error {
+	if this.closed {
+		return ErrTxClosed
+	}
+	// pending writes are merged in
+	keys := make([]string, 0, len(this.writes))
+	for k := range this.writes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	local := func(k string) error {
+		w := this.writes[k]
+		if w == nil {
+			return nil
+		}
+		return cb(Pair{Key: k, data: *w})
+	}
+
+	err := this.snap.range_(this.db, func(k string, val value) error {
+		for len(keys) > 0 && keys[0] < k {
+			err := local(keys[0])
+			if err != nil {
+				return err
+			}
+			keys = keys[1:]
+		}
+		if len(keys) > 0 && keys[0] == k {
+			keys = keys[1:]
+			return local(k)
+		}
+		if this.reads != nil {
+			this.reads[k] = true
+		}
+		p := val.pair(k, this.db)
+		p.kept = true
+		return cb(p)
+	})
+	for err == nil && len(keys) > 0 {
+		err = local(keys[0])
+		keys = keys[1:]
+	}
+	if err == trie.EOD {
+		return nil
+	}
+	return err
+}
+
+// A snapshot keeps the values the keys had when it was created, if they get changed afterwards.
+// The pages released by later changes are not reused until the snapshot is released.
+type snapshot struct {
+	seq uint64
+	old trie.Trie[*value] // the value before the first change, nil if the key didn't exist
+}
+
+// a value replaced by a commit
+type freed struct {
+	seq   uint64
+	epoch uint64
+	val   value
+}
+
+func (this *DB) snapshot() *snapshot {
+	this.m.Lock()
+	defer this.m.Unlock()
+	return this.snapshot_()
+}
+
+// must be called while holding the lock
+func (this *DB) snapshot_() *snapshot {
+	s := &snapshot{
+		seq: this.seq,
+	}
+	if this.snaps == nil {
+		this.snaps = map[*snapshot]struct{}{}
+	}
+	this.snaps[s] = struct{}{}
+	return s
+}
+
+func (this *DB) release(s *snapshot) {
+	this.m.Lock()
+	defer this.m.Unlock()
+	delete(this.snaps, s)
+	this.reclaim()
+}
+
+// save the current value of key in all the open snapshots
+// must be called while holding the lock, before changing the trie
+func (this *DB) remember(key string) {
+	if len(this.snaps) == 0 {
+		return
+	}
+	cur := this.trie.Get(key)
+	for s := range this.snaps {
+		s.remember(key, cur)
+	}
+}
+
+// free the space of the value, or put it in the pending list if some snapshot or reader may need it
+// must be called while holding the lock, after the trie has been changed
+func (this *DB) free(val value) {
+	if l, ok := val.loc(); ok && this.readers[l] != nil {
+		this.readers[l].freed = true // by the last Reader to close, see DB.Open
+		return
+	}
+	if len(this.snaps) == 0 && !this.pinned() {
+		this.autoPunch(this.dispose(val))
+	} else {
+		this.pending = append(this.pending, freed{this.seq, this.epoch.Load(), val})
+	}
+}
+
+func (this *snapshot) remember(key string, val *value) {
+	// only called by writers, while holding the lock, so there is no race between Get and Put
+	if this.old.Get(key) != nil {
+		return // only the first change matters
+	}
+	this.old.Put(key, val)
+}
+
+func (this *snapshot) lookup(key string) (val *value, ok bool) {
+	old := this.old.Get(key)
+	if old == nil {
+		return nil, false
+	}
+	return *old, true
+}
+
+// the old values for the keys in (from, to), or (from, ∞) if to is nil
+// if from is nil, start from the beginning
+func (this *snapshot) between(from, to *string) (keys []string, vals []value) {
+	if this.old.Count() == 0 {
+		return
+	}
+	start, end := "", ""
+	if from != nil {
+		start = *from
+	}
+	if to != nil {
+		if *to == "" {
+			return // nothing comes before the empty key
+		}
+		end = *to
+	}
+	_ = this.old.RangeBetween(start, end, func(k string, v *value) error {
+		if v != nil && (from == nil || k != *from) {
+			keys = append(keys, k)
+			vals = append(vals, *v)
+		}
+		return nil
+	})
+	return
+}
+
+func (this *snapshot) get(db *DB, key string) *value {
+	// writers remember the old value before changing the trie, so if we read
+	// a new value from the trie, the old one is already in the snapshot
+	cur := db.trie.Get(key)
+	if old, ok := this.lookup(key); ok {
+		return old
+	}
+	return cur
+}
+
+// range thru the keys as they were when the snapshot was taken
+func (this *snapshot) range_(db *DB, f func(string, value) error) error {
+	// the trie would swallow EOD, but we need to stop emitting too
+	var stop error
+	cb := func(k string, val value) error {
+		stop = f(k, val)
+		return stop
+	}
+	var last *string
+	emit := func(to *string) error {
+		keys, vals := this.between(last, to)
+		for i, k := range keys {
+			err := cb(k, vals[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := db.trie.Range(func(k string, val value) error {
+		// keys deleted since the snapshot are not in the trie anymore
+		err := emit(&k)
+		if err != nil {
+			return err
+		}
+		last = &k
+		if old, ok := this.lookup(k); ok {
+			if old == nil {
+				return nil // created after the snapshot
+			}
+			val = *old
+		}
+		return cb(k, val)
+	})
+	if stop != nil {
+		return stop
+	}
+	if err != nil {
+		return err
+	}
+	return emit(nil)
+}
@@ -0,0 +1,187 @@
+package goblin_test
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ohait/goblin"
+	"github.com/ohait/goblin/trie"
+)
+
+func TestView(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	defer db.Close()
+
+	noError(t, db.Store("a", long(1000)))
+	noError(t, db.Store("b", []byte("B")))
+	noError(t, db.Store("d", []byte("D")))
+
+	err = db.View(func(tx *goblin.Tx) error {
+		// change everything under the transaction feet
+		noError(t, db.Store("a", []byte("new")))
+		noError(t, db.Delete("b"))
+		noError(t, db.Store("c", []byte("C")))
+		// this would reuse the pages of "a" if they were released
+		noError(t, db.Store("e", long(2000)))
+
+		x, err := tx.Fetch("a")
+		noError(t, err)
+		if string(x) != string(long(1000)) {
+			t.Fatalf("expected long(1000), got %q", x)
+		}
+		x, err = tx.Fetch("c")
+		noError(t, err)
+		if x != nil {
+			t.Fatalf("expected nil, got %q", x)
+		}
+
+		var list []string
+		err = tx.Range(func(p goblin.Pair) error {
+			x, err := p.Fetch()
+			list = append(list, p.Key+"="+strconv.Itoa(len(x)))
+			return err
+		})
+		noError(t, err)
+		if strings.Join(list, ",") != "a=1000,b=1,d=1" {
+			t.Fatalf("unexpected range: %v", list)
+		}
+
+		noError(t, db.Delete("d"))
+		list = nil
+		err = tx.Range(func(p goblin.Pair) error {
+			list = append(list, p.Key)
+			return trie.EOD
+		})
+		noError(t, err)
+		if strings.Join(list, ",") != "a" {
+			t.Fatalf("unexpected range: %v", list)
+		}
+
+		if tx.Store("x", nil) != goblin.ErrTxReadOnly {
+			t.Fatalf("expected a read-only tx")
+		}
+		return nil
+	})
+	noError(t, err)
+
+	x, err := db.Fetch("a")
+	noError(t, err)
+	if string(x) != "new" {
+		t.Fatalf("expected new, got %q", x)
+	}
+	t.Logf("after view: %v", db)
+}
+
+func TestUpdate(t *testing.T) {
+	_ = os.RemoveAll("/tmp/test-goblin")
+	db, err := goblin.New("/tmp/test-goblin/")
+	noError(t, err)
+	defer db.Close()
+
+	noError(t, db.Store("b", []byte("B")))
+
+	fail := errors.New("fail")
+	err = db.Update(func(tx *goblin.Tx) error {
+		noError(t, tx.Store("a", []byte("A")))
+		return fail
+	})
+	if err != fail {
+		t.Fatalf("expected fail, got %v", err)
+	}
+	x, err := db.Fetch("a")
+	noError(t, err)
+	if x != nil {
+		t.Fatalf("rollback failed, got %q", x)
+	}
+
+	err = db.Update(func(tx *goblin.Tx) error {
+		noError(t, tx.Store("c", []byte("C")))
+		noError(t, tx.Store("a", []byte("A")))
+		noError(t, tx.Delete("b"))
+		x, err := tx.Fetch("a")
+		noError(t, err)
+		if string(x) != "A" {
+			t.Fatalf("expected A, got %q", x)
+		}
+		var list []string
+		err = tx.Range(func(p goblin.Pair) error {
+			x, err := p.Fetch()
+			list = append(list, p.Key+"="+string(x))
+			return err
+		})
+		noError(t, err)
+		if strings.Join(list, ",") != "a=A,c=C" {
+			t.Fatalf("unexpected range: %v", list)
+		}
+		return nil
+	})
+	noError(t, err)
+	if db.Size() != 2 {
+		t.Fatalf("expected 2 keys, got %d", db.Size())
+	}
+
+	// updates are serialized, so no increment is lost
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				err := db.Update(func(tx *goblin.Tx) error {
+					x, err := tx.Fetch("counter")
+					if err != nil {
+						return err
+					}
+					ct, _ := strconv.Atoi(string(x))
+					return tx.Store("counter", []byte(strconv.Itoa(ct+1)))
+				})
+				noError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	x, err = db.Fetch("counter")
+	noError(t, err)
+	if string(x) != "200" {
+		t.Fatalf("expected 200, got %q", x)
+	}
+
+	// a plain Store in the middle of an update is not lost
+	noError(t, db.Store("n", []byte("1")))
+	err = db.Update(func(tx *goblin.Tx) error {
+		x, err := tx.Fetch("n")
+		noError(t, err)
+		noError(t, db.Store("n", []byte("5")))
+		return tx.Store("n", append(x, '+'))
+	})
+	var conflict goblin.ErrConflict
+	if !errors.As(err, &conflict) || conflict.Key != "n" {
+		t.Fatalf("expected a conflict on n, got %v", err)
+	}
+	t.Logf("conflict: %v", err)
+	x, err = db.Fetch("n")
+	noError(t, err)
+	if string(x) != "5" {
+		t.Fatalf("expected 5, got %q", x)
+	}
+
+	// also for keys only written
+	err = db.Update(func(tx *goblin.Tx) error {
+		noError(t, db.Delete("n"))
+		return tx.Store("n", []byte("6"))
+	})
+	if !errors.As(err, &conflict) || conflict.Actual != 0 {
+		t.Fatalf("expected a conflict on n, got %v", err)
+	}
+	x, err = db.Fetch("n")
+	noError(t, err)
+	if x != nil {
+		t.Fatalf("expected n to be deleted, got %q", x)
+	}
+}
@@ -0,0 +1,490 @@
+package goblin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// the result of Verify or Repair
+type Report struct {
+	Keys        int    // live keys in the log
+	Pages       int    // pages in data.db
+	Used        int    // pages used by the live keys
+	Free        int    // pages before the last one in the log not used by any live key (they are reused on open)
+	TornTail    bool   // the log ends with an incomplete entry
+	LogCorrupt  string // where the log is corrupted, the entries after it are ignored
+	Checkpoint  string // how index.ckpt doesn't match the log, when Open would use it
+	Leaked      int    // pages marked as used in index.ckpt but used by none of its keys, Open never reuses them
+	Problems    []Problem
+	Quarantined []string // keys removed by Repair
+}
+
+// something wrong with the value of a key
+type Problem struct {
+	Key     string
+	Extents []Extent // the pages of the value
+	Reason  string
+}
+
+func (this Problem) String() string {
+	return fmt.Sprintf("%q (pages %v): %s", this.Key, this.Extents, this.Reason)
+}
+
+// true if nothing needs repairing
+func (this *Report) OK() bool {
+	return len(this.Problems) == 0 && this.LogCorrupt == "" && this.Checkpoint == "" && this.Leaked == 0
+}
+
+func (this *Report) String() string {
+	return fmt.Sprintf("{%d keys, %d/%d pages used, %d free, %d leaked, %d problems}",
+		this.Keys, this.Used, this.Pages, this.Free, this.Leaked, len(this.Problems))
+}
+
+// check the DB in dir, without opening it
+//
+// the log is replayed and cross-checked with data.db, looking for pages beyond the end of data.db,
+// pages used by more than one key, sizes not matching the pages, and checksum failures.
+// If Open would use index.ckpt, it's checked against the log, and its bitmap against its keys, looking for leaked pages.
+// It fails with ErrLocked if the DB is in use.
+func Verify(dir string) (*Report, error) {
+	v, err := newVerifier(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer v.close()
+	return v.report, nil
+}
+
+// like Verify, then move the keys with problems to quarantine.log and rebuild index.log without them
+// torn and corrupted entries in the log are dropped
+func Repair(dir string) (*Report, error) {
+	v, err := newVerifier(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer v.close()
+	return v.report, v.repair()
+}
+
+type verifier struct {
+	dir      string
+	pageSize int
+	data     *os.File
+	seq      uint64
+	live     map[string]value
+	keys     []string // sorted keys of live
+	bad      map[string]bool
+	report   *Report
+}
+
+func newVerifier(dir string) (*verifier, error) {
+	m, err := readMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+	if m.Magic != magic || m.Version < formatVersion {
+		return nil, fmt.Errorf("%q uses an older format, open it once to upgrade", dir)
+	}
+	this := &verifier{
+		dir:      dir,
+		pageSize: m.PageSize,
+		live:     map[string]value{},
+		bad:      map[string]bool{},
+		report:   &Report{},
+	}
+	this.data, err = os.Open(filepath.Join(dir, "data.db"))
+	if err != nil {
+		return nil, err
+	}
+	err = lock(this.data, -1)
+	if err != nil {
+		_ = this.data.Close()
+		return nil, err
+	}
+	err = this.check()
+	if err != nil {
+		this.close()
+		return nil, err
+	}
+	return this, nil
+}
+
+func (this *verifier) close() {
+	_ = this.data.Close() // releases the lock too
+}
+
+func (this *verifier) problem(key string, ext extents, f string, args ...any) {
+	this.bad[key] = true
+	this.report.Problems = append(this.report.Problems, Problem{key, ext, fmt.Sprintf(f, args...)})
+}
+
+// replay the log like rewind does, but without trusting it
+// when it gets where the checkpoint was taken, the checkpoint is compared with it
+func (this *verifier) replay(ck *ckptCheck) (seen map[int]bool, err error) {
+	f, err := os.Open(filepath.Join(this.dir, "index.log"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seen = map[int]bool{}
+	r, err := newLogReader(f, 0)
+	if err != nil {
+		return nil, err
+	}
+	if ck != nil && ck.c.off == 0 {
+		ck.trusted, ck.problem = true, this.compare(ck)
+	}
+	for {
+		payload, err := r.next()
+		if err == io.EOF {
+			return seen, nil
+		}
+		if err == errTorn {
+			this.report.TornTail = true
+			return seen, nil
+		}
+		var entry record
+		if err == nil {
+			entry, err = decode(payload)
+			if err != nil {
+				err = fmt.Errorf("index.log is corrupted at offset %d: %w", r.off-int64(frameHeader+len(payload)), err)
+			}
+		}
+		if err != nil {
+			this.report.LogCorrupt = err.Error()
+			return seen, nil
+		}
+		if entry.Version == 0 {
+			entry.Version = this.seq + 1
+		}
+		if ck != nil && ck.c.off > 0 && r.off > ck.c.off && entry.Version <= ck.c.seq {
+			ck.trusted = false // Open finds it stale
+		}
+		if entry.Version > this.seq {
+			this.seq = entry.Version
+		}
+		for _, rec := range entry.entries() {
+			if rec.Deleted {
+				delete(this.live, rec.Key)
+				continue
+			}
+			this.live[rec.Key] = rec.val()
+			for _, page := range rec.val().span(this.pageSize).pages() {
+				seen[page] = true
+			}
+		}
+		if ck != nil && r.off == ck.c.off && bytes.Equal(frame(payload)[:frameHeader], ck.c.last[:]) {
+			ck.trusted, ck.problem = true, this.compare(ck)
+		}
+	}
+}
+
+func (this *verifier) check() error {
+	fs, err := this.data.Stat()
+	if err != nil {
+		return err
+	}
+	pages := int(fs.Size() / int64(this.pageSize))
+	this.report.Pages = pages
+
+	ck := this.readCheckpoint(pages)
+	seen, err := this.replay(ck)
+	if err != nil {
+		return err
+	}
+	if ck != nil && ck.trusted {
+		this.report.Checkpoint = ck.problem
+		this.checkBitmap(ck)
+	}
+
+	for k := range this.live {
+		this.keys = append(this.keys, k)
+	}
+	sort.Strings(this.keys)
+	this.report.Keys = len(this.keys)
+
+	// a page is owned by a key, or each of its slots is
+	type spot struct {
+		page, class, slot int
+	}
+	owners := map[spot][]string{}
+	layout := map[int]int{}    // the slot size of each page in use, 0 for whole pages
+	valid := map[string]bool{} // the checksum matches
+	for _, k := range this.keys {
+		val := this.live[k]
+		inside := true
+		ext := val.span(this.pageSize)
+		for _, page := range ext.pages() {
+			if page < 0 || page >= pages {
+				this.problem(k, ext, "page %d is beyond the end of data.db", page)
+				inside = false
+				continue
+			}
+			if class, ok := layout[page]; ok && class != val.Class {
+				this.problem(k, ext, "page %d is also used by values of another size", page)
+				inside = false
+				continue
+			}
+			layout[page] = val.Class
+			owners[spot{page, val.Class, val.Slot}] = append(owners[spot{page, val.Class, val.Slot}], k)
+		}
+		if val.Inline != nil {
+			if len(val.Inline) != val.Size {
+				this.problem(k, nil, "%d bytes inline, expected %d", len(val.Inline), val.Size)
+			}
+			continue
+		} else if val.Class > 0 {
+			if val.Size > val.Class || val.Class > this.pageSize/2 {
+				this.problem(k, ext, "%d bytes don't fit in a slot of %d", val.Size, val.Class)
+				continue
+			}
+		} else if expect := (val.Size + this.pageSize - 1) / this.pageSize; expect != ext.count() {
+			this.problem(k, ext, "%d bytes need %d pages, found %d", val.Size, expect, ext.count())
+			continue
+		}
+		if !inside || !val.HasCRC {
+			continue
+		}
+		data, err := this.read(val)
+		if err != nil {
+			return err
+		}
+		if err := val.verify(k, data, this.pageSize); err != nil {
+			this.problem(k, ext, "checksum mismatch")
+		} else {
+			valid[k] = true
+		}
+	}
+
+	// when a page or a slot is shared, the newest key with a good checksum keeps it
+	this.report.Used = len(layout)
+	for at, keys := range owners {
+		if len(keys) < 2 {
+			continue
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return this.live[keys[i]].Version > this.live[keys[j]].Version
+		})
+		keep := ""
+		for _, k := range keys {
+			if valid[k] {
+				keep = k
+				break
+			}
+		}
+		for i, k := range keys {
+			if k != keep {
+				this.problem(k, this.live[k].span(this.pageSize), "page %d is also used by %q", at.page, keys[(i+1)%len(keys)])
+			}
+		}
+	}
+	sort.Slice(this.report.Problems, func(i, j int) bool {
+		return this.report.Problems[i].Key < this.report.Problems[j].Key
+	})
+
+	next := 0
+	for page := range seen {
+		if page >= next && page < pages {
+			next = page + 1
+		}
+	}
+	// like on open, the pages before next not used by a live key are free, even if the log doesn't mention them
+	for page := 0; page < next; page++ {
+		if _, used := layout[page]; !used {
+			this.report.Free++
+		}
+	}
+	return nil
+}
+
+func (this *verifier) read(val value) ([]byte, error) {
+	out := make([]byte, val.Size)
+	if val.Inline != nil {
+		return val.Inline, nil
+	}
+	if val.Class > 0 {
+		_, err := this.data.ReadAt(out, int64(val.Slot)*int64(val.Class))
+		if err != nil {
+			return nil, fmt.Errorf("can't read slot %d of %d bytes: %w", val.Slot, val.Class, err)
+		}
+		return out, nil
+	}
+	for i, page := range val.Extents.pages() {
+		start := i * this.pageSize
+		if start >= len(out) {
+			break // more pages than needed
+		}
+		end := start + this.pageSize
+		if end > len(out) {
+			end = len(out)
+		}
+		_, err := this.data.ReadAt(out[start:end], int64(page)*int64(this.pageSize))
+		if err != nil {
+			return nil, fmt.Errorf("can't read page %d: %w", page, err)
+		}
+	}
+	return out, nil
+}
+
+// an entry in quarantine.log
+type quarantined struct {
+	Key     string   `json:"key"`
+	Reasons []string `json:"reasons"`
+	Record  record   `json:"record"`
+	Data    []byte   `json:"data,omitempty"` // what could be read, it may be garbage
+}
+
+func (this *verifier) repair() error {
+	if len(this.bad) > 0 {
+		qname := filepath.Join(this.dir, "quarantine.log")
+		q, err := os.OpenFile(qname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		defer q.Close()
+		for _, k := range this.keys {
+			if !this.bad[k] {
+				continue
+			}
+			val := this.live[k]
+			entry := quarantined{Key: k, Record: val.record(k)}
+			for _, p := range this.report.Problems {
+				if p.Key == k {
+					entry.Reasons = append(entry.Reasons, p.Reason)
+				}
+			}
+			entry.Data, _ = this.read(val)
+			j, _ := json.Marshal(entry)
+			_, err = q.Write(append(j, '\n'))
+			if err != nil {
+				return fmt.Errorf("can't write %q: %w", qname, err)
+			}
+			this.report.Quarantined = append(this.report.Quarantined, k)
+		}
+		err = q.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	// the checkpoint would refer to the old log
+	err := os.Remove(filepath.Join(this.dir, ckptName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	logname := filepath.Join(this.dir, "index.log")
+	out, err := os.OpenFile(logname+"~", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	// like optimize, keep track of the last version first
+	_, err = w.Write(frame(record{Deleted: true, Version: this.seq}.encode()))
+	for _, k := range this.keys {
+		if err == nil && !this.bad[k] {
+			_, err = w.Write(frame(this.live[k].record(k).encode()))
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil {
+		err = os.Rename(logname+"~", logname)
+	}
+	return err
+}
+
+// index.ckpt, to cross-check it with the log
+type ckptCheck struct {
+	c       checkpoint
+	keys    map[string]value
+	bitmap  []uint64
+	trusted bool   // Open would use it: the log has the entry it was taken after, and nothing older after it
+	problem string // how it differs from the log at that point
+}
+
+// read index.ckpt, nil if it's missing or broken, Open would ignore it anyway
+func (this *verifier) readCheckpoint(pages int) *ckptCheck {
+	f, err := os.Open(filepath.Join(this.dir, ckptName))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	ck := &ckptCheck{
+		keys:   map[string]value{},
+		bitmap: make([]uint64, (pages+63)/64),
+	}
+	noCheck := func(checkpoint) error { return nil } // it's compared with the log while replaying it
+	ck.c, err = readCheckpoint(f, this.pageSize, int64(pages), ck.bitmap, noCheck, func(rec record) {
+		ck.keys[rec.Key] = rec.val()
+	})
+	if err != nil {
+		return nil
+	}
+	return ck
+}
+
+// compare the checkpoint with the keys replayed so far
+func (this *verifier) compare(ck *ckptCheck) string {
+	if ck.c.seq != this.seq {
+		return fmt.Sprintf("index.ckpt is at version %d, index.log at %d", ck.c.seq, this.seq)
+	}
+	var problems []string
+	for k, val := range ck.keys {
+		live, ok := this.live[k]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("index.ckpt has %q, which index.log doesn't", k))
+		case !bytes.Equal(val.record(k).encode(), live.record(k).encode()):
+			problems = append(problems, fmt.Sprintf("index.ckpt has %q at version %d, index.log at version %d", k, val.Version, live.Version))
+		}
+	}
+	for k := range this.live {
+		if _, ok := ck.keys[k]; !ok {
+			problems = append(problems, fmt.Sprintf("index.log has %q, which index.ckpt doesn't", k))
+		}
+	}
+	if len(problems) == 0 {
+		return ""
+	}
+	sort.Strings(problems)
+	if len(problems) > 1 {
+		return fmt.Sprintf("%s (and %d more)", problems[0], len(problems)-1)
+	}
+	return problems[0]
+}
+
+// look for pages marked as used in the checkpoint but not used by its keys, and the other way around
+func (this *verifier) checkBitmap(ck *ckptCheck) {
+	owned := make([]uint64, len(ck.bitmap))
+	for _, val := range ck.keys {
+		for _, e := range val.span(this.pageSize) {
+			for page := e.Start; page < e.end() && page/64 < len(owned); page++ {
+				owned[page/64] |= 1 << (page % 64)
+			}
+		}
+	}
+	for i, word := range ck.bitmap {
+		this.report.Leaked += bits.OnesCount64(word &^ owned[i])
+		if missing := owned[i] &^ word; missing != 0 && this.report.Checkpoint == "" {
+			page := i*64 + bits.TrailingZeros64(missing)
+			this.report.Checkpoint = fmt.Sprintf("page %d is used by a key, but free in the bitmap of index.ckpt", page)
+		}
+	}
+}
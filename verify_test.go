@@ -0,0 +1,172 @@
+package goblin_test
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ohait/goblin"
+)
+
+// append a raw record to index.log, encoded and framed like goblin does
+func appendLog(t *testing.T, dir string, key string, size int, version uint64, pages ...int) {
+	t.Helper()
+	payload := []byte{0}
+	payload = binary.AppendUvarint(payload, version)
+	payload = append(payload, 0)
+	payload = binary.AppendUvarint(payload, uint64(len(key)))
+	payload = append(payload, key...)
+	payload = binary.AppendUvarint(payload, uint64(size))
+	payload = binary.AppendUvarint(payload, uint64(len(pages)))
+	end := 0
+	for _, page := range pages { // an extent of 1 page each
+		payload = binary.AppendVarint(payload, int64(page-end))
+		payload = binary.AppendUvarint(payload, 1)
+		end = page + 1
+	}
+
+	f, err := os.OpenFile(dir+"/index.log", os.O_WRONLY|os.O_APPEND, 0)
+	noError(t, err)
+	defer f.Close()
+	castagnoli := crc32.MakeTable(crc32.Castagnoli)
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(payload, castagnoli))
+	binary.LittleEndian.PutUint32(header[8:12], crc32.Checksum(header[0:8], castagnoli))
+	_, err = f.Write(append(header, payload...))
+	noError(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	dir := "/tmp/test-goblin"
+	_ = os.RemoveAll(dir)
+	db, err := goblin.New(dir)
+	noError(t, err)
+	noError(t, db.Store("a", long(300))) // pages 0, 1
+	noError(t, db.Store("b", long(200))) // page 2, too big for a slot
+	noError(t, db.Store("c", long(200))) // page 3
+	noError(t, db.Store("c", long(200))) // page 4, 3 is free
+
+	_, err = goblin.Verify(dir)
+	if err != goblin.ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	noError(t, db.Close())
+
+	r, err := goblin.Verify(dir)
+	noError(t, err)
+	t.Logf("clean: %v", r)
+	if !r.OK() || r.Keys != 3 || r.Used != 4 || r.Free != 1 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+
+	// damage the value of a
+	f, err := os.OpenFile(dir+"/data.db", os.O_RDWR, 0)
+	noError(t, err)
+	_, err = f.WriteAt([]byte("X"), 10)
+	noError(t, err)
+	noError(t, f.Close())
+	// and write some bad records
+	appendLog(t, dir, "x", 1, 10, 2)     // shared with b
+	appendLog(t, dir, "y", 1, 11, 99999) // beyond data.db
+	appendLog(t, dir, "z", 1, 12, 6, 7)  // too many pages, 5 is free
+
+	r, err = goblin.Verify(dir)
+	noError(t, err)
+	t.Logf("damaged: %v", r)
+	var problems []string
+	for _, p := range r.Problems {
+		t.Logf("problem: %v", p)
+		problems = append(problems, p.Key)
+	}
+	if r.OK() || strings.Join(problems, ",") != "a,x,y,z" {
+		t.Fatalf("unexpected problems %v", problems)
+	}
+	if r.Free != 2 { // 3 and 5
+		t.Fatalf("expected 2 free pages, got %d", r.Free)
+	}
+
+	r, err = goblin.Repair(dir)
+	noError(t, err)
+	if strings.Join(r.Quarantined, ",") != "a,x,y,z" {
+		t.Fatalf("unexpected quarantine %v", r.Quarantined)
+	}
+	q, err := os.ReadFile(dir + "/quarantine.log")
+	noError(t, err)
+	if strings.Count(string(q), "\n") != 4 {
+		t.Fatalf("unexpected quarantine.log: %s", q)
+	}
+
+	r, err = goblin.Verify(dir)
+	noError(t, err)
+	t.Logf("repaired: %v", r)
+	if !r.OK() || r.Keys != 2 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+
+	db, err = goblin.New(dir)
+	noError(t, err)
+	defer db.Close()
+	x, err := db.Fetch("b")
+	noError(t, err)
+	if string(x) != string(long(200)) {
+		t.Fatalf("expected long(200), got %d bytes", len(x))
+	}
+}
+
+func TestVerifyCheckpoint(t *testing.T) {
+	// two DBs whose logs end with the same entry, so the checkpoint of one looks valid for the other
+	for _, k := range []string{"a", "b"} {
+		dir := "/tmp/test-goblin-" + k
+		_ = os.RemoveAll(dir)
+		db, err := goblin.New(dir)
+		noError(t, err)
+		noError(t, db.Store(k, long(300)))
+		noError(t, db.Store("z", long(300)))
+		noError(t, db.Close()) // writes index.ckpt
+		r, err := goblin.Verify(dir)
+		noError(t, err)
+		if !r.OK() || r.Checkpoint != "" || r.Leaked != 0 {
+			t.Fatalf("unexpected report %+v", r)
+		}
+	}
+	ckpt, err := os.ReadFile("/tmp/test-goblin-a/index.ckpt")
+	noError(t, err)
+	noError(t, os.WriteFile("/tmp/test-goblin-b/index.ckpt", ckpt, 0666))
+	r, err := goblin.Verify("/tmp/test-goblin-b")
+	noError(t, err)
+	t.Logf("foreign checkpoint: %s", r.Checkpoint)
+	if r.OK() || !strings.Contains(r.Checkpoint, `"a"`) {
+		t.Fatalf("unexpected report %+v", r)
+	}
+
+	// mark the free page 2 as used in the bitmap, the last word before the checksum
+	dir := "/tmp/test-goblin-a"
+	db, err := goblin.New(dir)
+	noError(t, err)
+	noError(t, db.Store("c", long(300))) // pages 4, 5
+	noError(t, db.Delete("z"))           // pages 2, 3
+	noError(t, db.Close())
+	ckpt, err = os.ReadFile(dir + "/index.ckpt")
+	noError(t, err)
+	word := ckpt[len(ckpt)-12 : len(ckpt)-4]
+	word[0] |= 1 << 2
+	binary.LittleEndian.PutUint32(ckpt[len(ckpt)-4:], crc32.Checksum(ckpt[:len(ckpt)-4], crc32.MakeTable(crc32.Castagnoli)))
+	noError(t, os.WriteFile(dir+"/index.ckpt", ckpt, 0666))
+	r, err = goblin.Verify(dir)
+	noError(t, err)
+	if r.OK() || r.Leaked != 1 || r.Checkpoint != "" {
+		t.Fatalf("unexpected report %+v", r)
+	}
+
+	// Repair drops the checkpoint
+	_, err = goblin.Repair(dir)
+	noError(t, err)
+	r, err = goblin.Verify(dir)
+	noError(t, err)
+	if !r.OK() || r.Keys != 2 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+}